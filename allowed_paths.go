@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// DisallowedPathAction is what happens to changes of an update script outside its allowed paths
+type DisallowedPathAction string
+
+const DisallowedPathFail DisallowedPathAction = "fail"
+const DisallowedPathDrop DisallowedPathAction = "drop"
+
+// DisallowedPathsError is returned when an update script changed files outside its allowed paths
+type DisallowedPathsError struct {
+	Paths []string
+}
+
+func (e *DisallowedPathsError) Error() string {
+	return fmt.Sprintf("changed paths outside allowed_paths: %s", strings.Join(e.Paths, ","))
+}
+
+func validateAllowedPaths(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("allowed_paths pattern=%s: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// disallowedPaths returns the changed paths of result that match none of patterns. No patterns allow every path.
+func disallowedPaths(patterns []string, result UpdateResult) []string {
+	if len(patterns) == 0 {
+		return nil
+	}
+	var out []string
+	for _, changedPath := range result.getPathsChanged() {
+		if !pathAllowed(patterns, changedPath) {
+			out = append(out, changedPath)
+		}
+	}
+	return out
+}
+
+// pathAllowed matches relPath against glob patterns relative to the flake root. * matches within one path element
+// and ** matches any number of elements. A pattern that matches a directory allows every file below it.
+func pathAllowed(patterns []string, relPath string) bool {
+	name := strings.Split(relPath, "/")
+	for _, pattern := range patterns {
+		patternElems := strings.Split(strings.Trim(pattern, "/"), "/")
+		for i := 1; i <= len(name); i++ {
+			if matchElems(patternElems, name[:i]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchElems(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchElems(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], name[0])
+	return ok && matchElems(pattern[1:], name[1:])
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"slices"
+	"testing"
+)
+
+func TestPathAllowed(t *testing.T) {
+	patterns := []string{"pkgs/foo", "**/*.json", "go.mod", "src/*/version.txt"}
+	for relPath, want := range map[string]bool{
+		"pkgs/foo/default.nix":   true,
+		"pkgs/foo":               true,
+		"pkgs/foobar/x.nix":      false,
+		"hash.json":              true,
+		"pkgs/bar/deps.json":     true,
+		"go.mod":                 true,
+		"go.sum":                 false,
+		"src/a/version.txt":      true,
+		"src/a/b/version.txt":    false,
+		"flake.lock":             false,
+		"pkgs/bar/deps.json.bak": false,
+	} {
+		if got := pathAllowed(patterns, relPath); got != want {
+			t.Errorf("path=%s allowed=%t want=%t", relPath, got, want)
+		}
+	}
+	if err := validateAllowedPaths([]string{"["}); err == nil {
+		t.Error("want error for bad pattern")
+	}
+}
+
+func TestRunUpdateScript_AllowedPaths(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, "pkgs/foo/version.txt", "1")
+	writeTestFile(t, root, "README.md", "readme")
+	script := UpdateScript{
+		Executable:   "sh",
+		Args:         []string{"-c", "echo 2 > pkgs/foo/version.txt && echo changed > README.md"},
+		AllowedPaths: []string{"pkgs/foo"},
+	}
+
+	_, err := RunUpdateScript(ScriptBuild{Output: "/bin"}, &script, root, &ScriptEnv{}, NewSnapshot(root), nil)
+	var disallowed *DisallowedPathsError
+	if !errors.As(err, &disallowed) || !slices.Equal(disallowed.Paths, []string{"README.md"}) {
+		t.Fatalf("err=%v", err)
+	}
+
+	script.OnDisallowedPath = string(DisallowedPathDrop)
+	result, err := RunUpdateScript(ScriptBuild{Output: "/bin"}, &script, root, &ScriptEnv{}, NewSnapshot(root), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := result.getPathsChanged(); !slices.Equal(got, []string{"pkgs/foo/version.txt"}) {
+		t.Errorf("changed=%v", got)
+	}
+	if got := sortedKeys(result.pathsRejected); !slices.Equal(got, []string{"README.md"}) {
+		t.Errorf("rejected=%v", got)
+	}
+	buf, err := os.ReadFile(path.Join(root, "README.md"))
+	if err != nil || string(buf) != "readme" {
+		t.Errorf("README.md=%q err=%v", buf, err)
+	}
+}
+
+func TestRunUpdateScript_DropKeepsOtherChanges(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, "flake.lock", "{}")
+	// the input update changed flake.lock before the script runs
+	out := NewUpdateResult()
+	out.addPath("flake.lock")
+	script := UpdateScript{
+		Executable:       "sh",
+		Args:             []string{"-c", "echo '{\"x\": 1}' > flake.lock && echo 2 > version.txt"},
+		AllowedPaths:     []string{"version.txt"},
+		OnDisallowedPath: string(DisallowedPathDrop),
+	}
+	scriptOut, err := RunUpdateScript(ScriptBuild{Output: "/bin"}, &script, root, &ScriptEnv{}, NewSnapshot(root), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.union(scriptOut)
+	if got := out.getPathsChanged(); !slices.Equal(got, []string{"flake.lock", "version.txt"}) {
+		t.Errorf("changed=%v", got)
+	}
+	if got := sortedKeys(out.pathsRejected); !slices.Equal(got, []string{"flake.lock"}) {
+		t.Errorf("rejected=%v", got)
+	}
+	buf, err := os.ReadFile(path.Join(root, "flake.lock"))
+	if err != nil || string(buf) != "{}" {
+		t.Errorf("flake.lock=%q err=%v", buf, err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"github.com/squalus/freshen/flake"
+	"log"
+	"time"
+)
+
+// bisectInput searches the upstream commits between the locked revision of an input and its newest revision for
+// the newest revision that passes the task's builds and tests. Commits on the input's deny list are skipped. config
+// must only list the one input. The input is left locked to that revision and snapshot adopts the original content
+// of the files the run at that revision changed. Returns an error if no newer revision passes.
+func (a *UpdateSpec) bisectInput(config *UpdateTask, inputName string, requiredResult UpdateResult, check bool, snapshot *Snapshot) (UpdateResult, error) {
+	oldLocks, err := a.Flake.MetadataLocks()
+	if err != nil {
+		return UpdateResult{}, fmt.Errorf("flake.MetadataLocks %w", err)
+	}
+	node, ok := oldLocks.Node(inputName)
+	if !ok || node.Locked.Rev == "" {
+		return UpdateResult{}, fmt.Errorf("missing input in lock file: %s", inputName)
+	}
+	oldRev := node.Locked.Rev
+
+	newRev, err := a.newestRev(config, inputName, oldLocks)
+	if err != nil {
+		return UpdateResult{}, fmt.Errorf("newestRev %w", err)
+	}
+	if newRev == oldRev {
+		return UpdateResult{}, fmt.Errorf("inputName=%s has no newer revision to bisect", inputName)
+	}
+
+	commits, err := listUpstreamCommits(node.Locked, oldRev, newRev)
+	if err != nil {
+		return UpdateResult{}, fmt.Errorf("listUpstreamCommits %w", err)
+	}
+	commits, err = withoutDenied(config, inputName, node.Locked, commits)
+	if err != nil {
+		return UpdateResult{}, fmt.Errorf("withoutDenied %w", err)
+	}
+	if len(commits) == 0 {
+		return UpdateResult{}, fmt.Errorf("inputName=%s no allowed commits between %s and %s", inputName, oldRev, newRev)
+	}
+
+	log.Printf("name=%s inputName=%s bisecting %d commits %s..%s", config.Name, inputName, len(commits), oldRev, newRev)
+	good, bad := bisectCommits(commits, func(rev string, left int) bool {
+		log.Printf("name=%s inputName=%s bisect trying rev=%s (%d commits left)", config.Name, inputName, rev, left)
+		_, err := a.runAtRev(config, node, inputName, rev, requiredResult, check, nil, true)
+		if err != nil {
+			log.Printf("name=%s inputName=%s bisect rev=%s bad: %s", config.Name, inputName, rev, err)
+			return false
+		}
+		log.Printf("name=%s inputName=%s bisect rev=%s good", config.Name, inputName, rev)
+		return true
+	})
+
+	firstBad := commits[bad].Rev
+	if good == -1 {
+		return UpdateResult{}, fmt.Errorf("inputName=%s first bad rev=%s is the first commit after %s", inputName, firstBad, oldRev)
+	}
+	goodRev := commits[good].Rev
+	log.Printf("name=%s inputName=%s newest good rev=%s first bad rev=%s", config.Name, inputName, goodRev, firstBad)
+	out, err := a.runAtRev(config, node, inputName, goodRev, requiredResult, check, snapshot, false)
+	if err != nil {
+		return UpdateResult{}, fmt.Errorf("inputName=%s rev=%s passed during bisect but failed on rerun: %w", inputName, goodRev, err)
+	}
+	out.holdBack(inputName, fmt.Sprintf("locked to rev=%s instead of rev=%s. first bad rev=%s", goodRev, newRev, firstBad))
+	return out, nil
+}
+
+// bisectCommits finds the newest commit that passes, assuming that all commits before it pass and all after it fail.
+// passes checks a revision. left is the number of commits that are still unknown. commits[good] passes and
+// commits[bad] is the first commit that fails. good is -1 if no commit passes, the locked revision before the first
+// commit is assumed to pass. The last commit is known to fail and is not checked.
+func bisectCommits(commits []UpstreamCommit, passes func(rev string, left int) bool) (good, bad int) {
+	good, bad = -1, len(commits)-1
+	for bad-good > 1 {
+		mid := (good + bad) / 2
+		if passes(commits[mid].Rev, bad-good-1) {
+			good = mid
+		} else {
+			bad = mid
+		}
+	}
+	return good, bad
+}
+
+// newestRev finds the revision that updating an input would lock, without changing the lock file. Like an update, it
+// respects the policy, min_age and deny list of the input. Returns the locked revision if there is no newer one.
+func (a *UpdateSpec) newestRev(config *UpdateTask, inputName string, oldLocks flake.Locks) (string, error) {
+	snapshot := NewSnapshot(a.Flake.Path)
+	if err := snapshot.Save("flake.lock"); err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = snapshot.Restore()
+	}()
+	result, err := a.updateInput(config, inputName, oldLocks)
+	if err != nil {
+		return "", fmt.Errorf("updateInput: %w", err)
+	}
+	if result == nil {
+		newRev, _ := oldLocks.InputRev(inputName)
+		return newRev, nil
+	}
+	return result.new, nil
+}
+
+// runAtRev locks an input to rev and runs the rest of the task. With restore set, or if the task fails, the files
+// it changed are restored afterwards. Otherwise taskSnapshot adopts their original content.
+func (a *UpdateSpec) runAtRev(config *UpdateTask, node flake.LockNode, inputName, rev string, requiredResult UpdateResult, check bool, taskSnapshot *Snapshot, restore bool) (UpdateResult, error) {
+	snapshot, err := a.newTaskSnapshot(config)
+	if err != nil {
+		return UpdateResult{}, err
+	}
+	flakeRef, err := upstreamFlakeRef(node.Locked, rev)
+	if err != nil {
+		return UpdateResult{}, err
+	}
+	out := NewUpdateResult()
+	out.union(requiredResult)
+	err = a.runHooks(config, StepKindPreUpdate, config.PreUpdate, &out, snapshot)
+	if err == nil {
+		start := time.Now()
+		err = a.Flake.LockInput(inputName, flakeRef)
+		if err != nil {
+			a.recorder.add(StepKindInput, inputName, start, StepStatusFailed, err.Error())
+		} else {
+			a.recorder.add(StepKindInput, inputName, start, StepStatusChanged, node.Locked.Rev+" -> "+rev)
+		}
+	}
+	if err == nil {
+		out.addPath("flake.lock")
+		out.changeInput(inputName, node.Locked.Rev, rev)
+		out, err = a.runStepsAfterInputs(config, out, true, check, snapshot)
+	}
+	if err != nil || restore {
+		if restoreErr := snapshot.Restore(); restoreErr != nil {
+			return UpdateResult{}, fmt.Errorf("restore failed: %w", restoreErr)
+		}
+		return out, err
+	}
+	taskSnapshot.Adopt(snapshot)
+	return out, nil
+}
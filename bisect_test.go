@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"github.com/squalus/freshen/flake"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBisectCommits(t *testing.T) {
+	var commits []UpstreamCommit
+	for i := range 10 {
+		commits = append(commits, UpstreamCommit{Rev: fmt.Sprintf("rev%d", i)})
+	}
+	for firstBad := 0; firstBad < len(commits); firstBad++ {
+		var tried []string
+		good, bad := bisectCommits(commits, func(rev string, left int) bool {
+			tried = append(tried, rev)
+			return slices.IndexFunc(commits, func(c UpstreamCommit) bool { return c.Rev == rev }) < firstBad
+		})
+		if good != firstBad-1 || bad != firstBad {
+			t.Errorf("firstBad=%d good=%d bad=%d", firstBad, good, bad)
+		}
+		if slices.Contains(tried, commits[len(commits)-1].Rev) {
+			t.Errorf("firstBad=%d checked the newest commit, which is known to fail", firstBad)
+		}
+		// 9 unknown commits take at most 4 checks
+		if len(tried) > 4 {
+			t.Errorf("firstBad=%d tried=%v", firstBad, tried)
+		}
+	}
+
+	good, bad := bisectCommits(commits[:1], func(rev string, left int) bool {
+		t.Errorf("checked rev=%s of a single commit", rev)
+		return false
+	})
+	if good != -1 || bad != 0 {
+		t.Errorf("single commit good=%d bad=%d", good, bad)
+	}
+}
+
+// bisectTestUpstream creates an upstream git repo with a commit per message, each age older than now, and a fake nix
+// that locks the input lib to revisions of it. Builds fail at commits whose message contains "broken". Returns the
+// flake root with lib locked to the first commit, the commit revisions and the file that logs the locked revisions.
+func bisectTestUpstream(t *testing.T, messages []string, ages []time.Duration) (string, []string, string) {
+	t.Helper()
+	now := time.Now()
+	upstream := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		out, err := runGit(upstream, append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(out)
+	}
+	git("init", "-q", "-b", "main")
+	var revs []string
+	for i, message := range messages {
+		commitTime := now.Add(-ages[i]).Truncate(time.Second).Format(time.RFC3339)
+		t.Setenv("GIT_COMMITTER_DATE", commitTime)
+		t.Setenv("GIT_AUTHOR_DATE", commitTime)
+		git("commit", "-q", "--allow-empty", "-m", message)
+		revs = append(revs, git("rev-parse", "HEAD"))
+	}
+
+	lockedRevs := path.Join(t.TempDir(), "locked")
+	fakeNix(t, strings.NewReplacer("UPSTREAM", upstream, "LOCKED", lockedRevs).Replace(`lock() {
+  echo "$1" >> LOCKED
+  printf '{"nodes": {"lib": {"locked": {"type": "git", "url": "file://UPSTREAM", "rev": "%s", "lastModified": %s}, "original": {"type": "git", "url": "file://UPSTREAM"}}, "root": {"inputs": {"lib": "lib"}}}, "root": "root", "version": 7}' "$1" "$(git -C UPSTREAM log -1 --format=%ct "$1")" > flake.lock
+}
+case "$1 $2 $3" in
+"flake lock --update-input") lock "$(git -C UPSTREAM rev-parse HEAD)" ;;
+"flake lock --override-input") lock "${5##*rev=}" ;;
+"build -L "*) rev=$(sed 's/.*"rev": "\([0-9a-f]*\)".*/\1/' flake.lock)
+  if git -C UPSTREAM log -1 --format=%s "$rev" | grep -q broken; then echo "error: builder for '/nix/store/abc-lib.drv' failed with exit code 1" >&2; exit 1; fi ;;
+esac`))
+
+	root := t.TempDir()
+	oldTime := now.Add(-ages[0]).Truncate(time.Second).Unix()
+	writeTestFile(t, root, "flake.lock", fmt.Sprintf(`{"nodes": {"lib": {"locked": {"type": "git", "url": "file://%s", "rev": "%s", "lastModified": %d}, "original": {"type": "git", "url": "file://%s"}}, "root": {"inputs": {"lib": "lib"}}}, "root": "root", "version": 7}`, upstream, revs[0], oldTime, upstream))
+	return root, revs, lockedRevs
+}
+
+func TestBisectInput_MinAge(t *testing.T) {
+	day := 24 * time.Hour
+	root, revs, lockedRevs := bisectTestUpstream(t,
+		[]string{"locked", "good", "good", "good but young", "broken and young"},
+		[]time.Duration{10 * day, 9 * day, 8 * day, time.Hour, 30 * time.Minute})
+	spec := &UpdateSpec{Flake: flake.Flake{Path: root}, Config: &FreshenConfig{}}
+	config := &UpdateTask{Name: "task", Inputs: []string{"lib"}, MainAttrPath: "default", MinAge: "2d"}
+	// the range ends at revs[2], the newest revision old enough, which the failed task run locked
+	result, err := spec.bisectInput(config, "lib", NewUpdateResult(), false, NewSnapshot(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	locks, err := spec.Flake.MetadataLocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev, _ := locks.InputRev("lib"); rev != revs[1] {
+		t.Errorf("locked rev=%s want=%s", rev, revs[1])
+	}
+	if !slices.Equal(result.getHeldBack(), []string{"lib"}) {
+		t.Errorf("heldBack=%v", result.getHeldBack())
+	}
+	buf, err := os.ReadFile(lockedRevs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// lockNewest locks the newest commit before min_age steps back
+	if tried := strings.Fields(string(buf)); slices.Contains(tried[1:], revs[3]) || slices.Contains(tried[1:], revs[4]) {
+		t.Errorf("bisect tried a revision younger than min_age: %v", tried)
+	}
+}
+
+func TestBisectInput_Deny(t *testing.T) {
+	root, revs, lockedRevs := bisectTestUpstream(t,
+		[]string{"locked", "good", "good but denied", "broken", "broken and denied"},
+		[]time.Duration{5 * time.Hour, 4 * time.Hour, 3 * time.Hour, 2 * time.Hour, time.Hour})
+	spec := &UpdateSpec{Flake: flake.Flake{Path: root}, Config: &FreshenConfig{}}
+	config := &UpdateTask{Name: "task", Inputs: []string{"lib"}, MainAttrPath: "default", InputPolicies: map[string]InputPolicy{
+		"lib": {Deny: []DenyRule{{Rev: revs[2][:12]}, {Rev: revs[4]}}},
+	}}
+	// the deny list pins the range end to revs[3]. revs[2] passes, but must not be picked.
+	result, err := spec.bisectInput(config, "lib", NewUpdateResult(), false, NewSnapshot(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	locks, err := spec.Flake.MetadataLocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev, _ := locks.InputRev("lib"); rev != revs[1] {
+		t.Errorf("locked rev=%s want=%s", rev, revs[1])
+	}
+	if !slices.Equal(result.getHeldBack(), []string{"lib"}) {
+		t.Errorf("heldBack=%v", result.getHeldBack())
+	}
+	buf, err := os.ReadFile(lockedRevs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// lockNewest locks the newest commit before the deny list pins it
+	if tried := strings.Fields(string(buf)); slices.Contains(tried, revs[2]) || slices.Contains(tried[1:], revs[4]) {
+		t.Errorf("bisect tried a denied revision: %v", tried)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+type FailureClass string
+
+const (
+	FailureEvaluation   FailureClass = "evaluation"
+	FailureBuild        FailureClass = "build"
+	FailureHashMismatch FailureClass = "hash_mismatch"
+	FailureFetch        FailureClass = "fetch"
+	FailureTimeout      FailureClass = "timeout"
+	FailureUnknown      FailureClass = "unknown"
+)
+
+// failurePatterns are checked in order. The first class with a pattern in the output wins.
+var failurePatterns = []struct {
+	class    FailureClass
+	patterns []string
+}{
+	{FailureHashMismatch, []string{"hash mismatch in fixed-output derivation"}},
+	{FailureTimeout, []string{"timed out after", "the build timed out", "silent for more than"}},
+	{FailureFetch, []string{
+		"unable to download",
+		"Could not resolve host",
+		"Couldn't resolve host",
+		"Failed to connect",
+		"Connection reset by peer",
+		"Connection timed out",
+		"Timeout was reached",
+		"SSL connect error",
+		"HTTP error 50",
+		"error: cannot connect",
+		"unable to access",
+		"failed to fetch",
+		"Temporary failure in name resolution",
+	}},
+	{FailureEvaluation, []string{
+		"while evaluating",
+		"error: undefined variable",
+		"error: attribute '",
+		"does not provide attribute",
+		"error: syntax error",
+		"infinite recursion encountered",
+		"error: assertion",
+		"evaluation aborted",
+	}},
+	{FailureBuild, []string{"builder for '", "Cannot build '", "dependencies couldn't be built", "build of '"}},
+}
+
+// ClassifyFailure inspects the output of a failed nix command to find out why it failed. Only nix's own error block is
+// considered, so a builder log that happens to print something like "Failed to connect" does not change the class.
+func ClassifyFailure(output string) FailureClass {
+	block := nixErrorBlock(output)
+	for _, cur := range failurePatterns {
+		for _, pattern := range cur.patterns {
+			if strings.Contains(block, pattern) {
+				return cur.class
+			}
+		}
+	}
+	return FailureUnknown
+}
+
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// builderLogLine matches the "name> " prefix nix -L puts in front of builder output
+var builderLogLine = regexp.MustCompile(`^[^\s>]+> `)
+
+// nixErrorBlock returns the part of the output that nix printed itself, starting at the first line beginning with
+// "error:". Builder log lines and the log tail quoted in the error ("       > ...") are dropped. If there is no error
+// line, all of nix's own lines are returned.
+func nixErrorBlock(output string) string {
+	var lines []string
+	inBlock := false
+	for _, line := range strings.Split(ansiEscape.ReplaceAllString(output, ""), "\n") {
+		if builderLogLine.MatchString(line) || strings.HasPrefix(strings.TrimSpace(line), ">") {
+			continue
+		}
+		if !inBlock && strings.HasPrefix(line, "error:") {
+			inBlock = true
+			lines = nil
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// defaultRetryOn are the failure classes retried when a retry config does not list any
+var defaultRetryOn = []string{string(FailureFetch), string(FailureTimeout)}
+
+const defaultRetryBackoff = 10 * time.Second
+
+// retries reports whether a failure class is retried
+func (r *RetryConfig) retries(class FailureClass) bool {
+	retryOn := r.RetryOn
+	if len(retryOn) == 0 {
+		retryOn = defaultRetryOn
+	}
+	return slices.Contains(retryOn, string(class))
+}
+
+func (r *RetryConfig) backoff() (time.Duration, error) {
+	if r.Backoff == "" {
+		return defaultRetryBackoff, nil
+	}
+	out, err := time.ParseDuration(r.Backoff)
+	if err != nil {
+		return 0, fmt.Errorf("retry backoff: %w", err)
+	}
+	return out, nil
+}
+
+// buildWithRetry builds attrPath. Failures of a class listed in retry are retried with exponential backoff. A
+// nil retry config builds once. Errors are annotated with the failure class.
+func (a *UpdateSpec) buildWithRetry(attrPath string, sandbox bool, retry *RetryConfig) (stdout, stderr string, err error) {
+	attempts := 1
+	backoff := defaultRetryBackoff
+	if retry != nil {
+		if retry.Attempts > 1 {
+			attempts = retry.Attempts
+		}
+		if backoff, err = retry.backoff(); err != nil {
+			return "", "", err
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		stdout, stderr, err = a.Flake.BuildWithRawOutput(attrPath, sandbox)
+		if err == nil {
+			return stdout, stderr, nil
+		}
+		class := ClassifyFailure(stderr)
+		err = fmt.Errorf("%s failure: %w", class, err)
+		if attempt >= attempts || !retry.retries(class) {
+			return stdout, stderr, err
+		}
+		log.Printf("attrPath=%s attempt %d/%d failed with class=%s, retrying in %s", attrPath, attempt, attempts, class, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestClassifyFailure(t *testing.T) {
+	buf, err := os.ReadFile(path.Join("test-data", "hash-mismatch.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]FailureClass{
+		string(buf): FailureHashMismatch,
+		"error: builder for '/nix/store/abc-foo.drv' failed with exit code 2":                               FailureBuild,
+		"error: unable to download 'https://example.com/x.tar.gz': Could not resolve host: example.com (6)": FailureFetch,
+		"error: building of '/nix/store/abc-foo.drv' timed out after 3600 seconds":                          FailureTimeout,
+		"error: undefined variable 'foo'\n       at /nix/store/abc-source/flake.nix:5:3":                    FailureEvaluation,
+		"something else went wrong": FailureUnknown,
+		// builder logs mention network and evaluation errors, but nix reports a build failure
+		"foo> curl: (7) Failed to connect to localhost port 8080: Connection refused\n" +
+			"foo> FAIL: test_client\n" +
+			"error: builder for '/nix/store/abc-foo.drv' failed with exit code 1;\n" +
+			"       last 2 log lines:\n" +
+			"       > curl: (7) Failed to connect to localhost port 8080: Connection refused\n" +
+			"       > FAIL: test_client\n" +
+			"       For full logs, run 'nix log /nix/store/abc-foo.drv'.": FailureBuild,
+		"foo> checking error messages while evaluating templates... ok\n" +
+			"foo> make: *** [Makefile:12: check] Error 2\n" +
+			"error: builder for '/nix/store/abc-foo.drv' failed with exit code 2": FailureBuild,
+		"\x1b[31;1merror:\x1b[0m unable to download 'https://example.com/x.tar.gz': HTTP error 503": FailureFetch,
+	}
+	for output, want := range cases {
+		if got := ClassifyFailure(output); got != want {
+			t.Errorf("output=%q got=%s want=%s", output, got, want)
+		}
+	}
+}
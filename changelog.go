@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/go-github/v48/github"
+	"github.com/squalus/freshen/flake"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxChangelogCommits limits the commits stored in a changelog. TotalCommits has the full count.
+const maxChangelogCommits = 100
+
+// commit messages list fewer commits and shorten release notes
+const (
+	maxMessageCommits      = 20
+	maxMessageReleases     = 5
+	maxMessageReleaseNotes = 1000
+)
+
+// Changelog is what changed upstream between the old and new revision of an input
+type Changelog struct {
+	Input  string `json:"input"`
+	OldRev string `json:"old_rev"`
+	NewRev string `json:"new_rev"`
+	// CompareURL shows the full range in a browser. Only set for GitHub inputs.
+	CompareURL string `json:"compare_url,omitempty"`
+	// Commits are the oldest commits of the range, oldest first, up to maxChangelogCommits
+	Commits      []ChangelogCommit `json:"commits"`
+	TotalCommits int               `json:"total_commits"`
+	// Releases are the tags that point to a commit of the full range, including ones not in Commits. Notes are only
+	// available for GitHub inputs.
+	Releases []ChangelogRelease `json:"releases"`
+	// Error is set if the changelog could not be fetched
+	Error string `json:"error,omitempty"`
+}
+
+type ChangelogCommit struct {
+	Rev     string    `json:"rev"`
+	Time    time.Time `json:"time"`
+	Subject string    `json:"subject"`
+}
+
+type ChangelogRelease struct {
+	Tag   string `json:"tag"`
+	Name  string `json:"name,omitempty"`
+	URL   string `json:"url,omitempty"`
+	Notes string `json:"notes,omitempty"`
+}
+
+// addChangelogs fetches a changelog for each changed input of result that does not have one yet. Inputs inherited
+// from required tasks already have one. Errors are stored in the changelog and do not fail the task.
+func (a *UpdateSpec) addChangelogs(config *UpdateTask, result *UpdateResult) {
+	if len(result.inputsChanged) == 0 {
+		return
+	}
+	locks, err := a.Flake.MetadataLocks()
+	if err != nil {
+		log.Printf("name=%s cannot read lock file for changelogs: %s", config.Name, err)
+		return
+	}
+	for _, inputName := range sortedKeys(result.inputsChanged) {
+		if _, ok := result.changelogs[inputName]; ok {
+			continue
+		}
+		change := result.inputsChanged[inputName]
+		changelog := Changelog{Input: inputName, OldRev: change.old, NewRev: change.new}
+		node, ok := locks.Node(inputName)
+		if !ok {
+			changelog.Error = "missing input in lock file"
+		} else if err := a.fetchChangelog(node.Locked, &changelog); err != nil {
+			log.Printf("name=%s inputName=%s cannot fetch changelog: %s", config.Name, inputName, err)
+			changelog.Error = err.Error()
+		}
+		result.addChangelog(changelog)
+	}
+}
+
+// fetchChangelog fills in the commits and releases of changelog. GitHub inputs use the GitHub API and fall back to
+// git if it fails. Other inputs use git.
+func (a *UpdateSpec) fetchChangelog(info flake.LockInfo, changelog *Changelog) error {
+	if info.Type == "github" && (info.Host == "" || info.Host == "github.com") {
+		err := a.fetchGitHubChangelog(info, changelog)
+		if err == nil {
+			return nil
+		}
+		log.Printf("inputName=%s GitHub compare failed, using git: %s", changelog.Input, err)
+		*changelog = Changelog{Input: changelog.Input, OldRev: changelog.OldRev, NewRev: changelog.NewRev}
+	}
+	commits, err := listUpstreamCommits(info, changelog.OldRev, changelog.NewRev)
+	if err != nil {
+		return fmt.Errorf("listUpstreamCommits: %w", err)
+	}
+	changelog.TotalCommits = len(commits)
+	var revs []string
+	for _, commit := range commits {
+		revs = append(revs, commit.Rev)
+		if len(changelog.Commits) < maxChangelogCommits {
+			changelog.Commits = append(changelog.Commits, ChangelogCommit{Rev: commit.Rev, Time: commit.Time.UTC(), Subject: commit.Subject})
+		}
+	}
+	changelog.Releases = taggedReleases(info, revs, changelog.NewRev)
+	return nil
+}
+
+func (a *UpdateSpec) fetchGitHubChangelog(info flake.LockInfo, changelog *Changelog) error {
+	ctx := context.Background()
+	client := a.GitHub
+	if client == nil {
+		client = github.NewClient(nil)
+	}
+	// all pages are needed to find the tags of the range
+	opts := &github.ListOptions{PerPage: maxChangelogCommits}
+	var revs []string
+	for {
+		comparison, resp, err := client.Repositories.CompareCommits(ctx, info.Owner, info.Repo, changelog.OldRev, changelog.NewRev, opts)
+		if err != nil {
+			return fmt.Errorf("github.Repositories.CompareCommits %w", err)
+		}
+		changelog.CompareURL = comparison.GetHTMLURL()
+		changelog.TotalCommits = comparison.GetTotalCommits()
+		for _, commit := range comparison.Commits {
+			revs = append(revs, commit.GetSHA())
+			if len(changelog.Commits) == maxChangelogCommits {
+				continue
+			}
+			subject, _, _ := strings.Cut(commit.GetCommit().GetMessage(), "\n")
+			changelog.Commits = append(changelog.Commits, ChangelogCommit{
+				Rev:     commit.GetSHA(),
+				Time:    commit.GetCommit().GetCommitter().GetDate().UTC(),
+				Subject: subject,
+			})
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	releases := taggedReleases(info, revs, changelog.NewRev)
+	for i := range releases {
+		release, _, err := client.Repositories.GetReleaseByTag(ctx, info.Owner, info.Repo, releases[i].Tag)
+		if err != nil {
+			// most tags have no release
+			continue
+		}
+		releases[i].Name = release.GetName()
+		releases[i].URL = release.GetHTMLURL()
+		releases[i].Notes = release.GetBody()
+	}
+	changelog.Releases = releases
+	return nil
+}
+
+// taggedReleases lists the upstream tags that point to one of revs or to newRev, in commit order. revs are the
+// commits of the range, oldest first.
+func taggedReleases(info flake.LockInfo, revs []string, newRev string) []ChangelogRelease {
+	out := []ChangelogRelease{}
+	if len(revs) == 0 {
+		return out
+	}
+	if revs[len(revs)-1] != newRev {
+		revs = append(revs, newRev)
+	}
+	tags, err := listUpstreamTags(info)
+	if err != nil {
+		log.Printf("cannot list upstream tags: %s", err)
+		return out
+	}
+	tagsByRev := make(map[string][]string)
+	for _, tag := range tags {
+		tagsByRev[tag.Rev] = append(tagsByRev[tag.Rev], tag.Name)
+	}
+	for _, rev := range revs {
+		for _, name := range tagsByRev[rev] {
+			out = append(out, ChangelogRelease{Tag: name})
+		}
+	}
+	return out
+}
+
+// FormatCommitMessage builds the commit message for the changes of an update task: the paragraphs and versions
+// reported by update scripts, the upstream changelog of each changed input and the notes of update scripts. Long
+// changelogs are truncated.
+func FormatCommitMessage(name string, result UpdateResult) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s: update\n", name)
+	for _, fragment := range result.messageFragments {
+		fmt.Fprintf(&sb, "\n%s\n", fragment)
+	}
+	if len(result.versionsChanged) > 0 {
+		sb.WriteString("\n")
+		for _, versionName := range sortedKeys(result.versionsChanged) {
+			change := result.versionsChanged[versionName]
+			fmt.Fprintf(&sb, "%s: %s -> %s\n", versionName, change.old, change.new)
+		}
+	}
+	for _, inputName := range sortedKeys(result.inputsChanged) {
+		change := result.inputsChanged[inputName]
+		fmt.Fprintf(&sb, "\n%s: %s -> %s\n", inputName, shortRev(change.old), shortRev(change.new))
+		changelog, ok := result.changelogs[inputName]
+		if !ok {
+			continue
+		}
+		sb.WriteString(formatChangelog(changelog))
+	}
+	for _, hashPath := range sortedKeys(result.hashesChanged) {
+		fmt.Fprintf(&sb, "\n%s: hash updated\n", hashPath)
+	}
+	if len(result.notes) > 0 {
+		sb.WriteString("\nNotes:\n")
+		for _, note := range result.notes {
+			fmt.Fprintf(&sb, "- %s\n", note)
+		}
+	}
+	return sb.String()
+}
+
+func formatChangelog(changelog Changelog) string {
+	var sb strings.Builder
+	if changelog.Error != "" {
+		fmt.Fprintf(&sb, "changelog unavailable: %s\n", changelog.Error)
+		return sb.String()
+	}
+	if changelog.CompareURL != "" {
+		fmt.Fprintf(&sb, "%s\n", changelog.CompareURL)
+	}
+	commits := changelog.Commits
+	if len(commits) > maxMessageCommits {
+		commits = commits[:maxMessageCommits]
+	}
+	for _, commit := range commits {
+		fmt.Fprintf(&sb, "- %s %s\n", shortRev(commit.Rev), commit.Subject)
+	}
+	if more := changelog.TotalCommits - len(commits); more > 0 {
+		fmt.Fprintf(&sb, "- ... and %d more commits\n", more)
+	}
+	releases := changelog.Releases
+	if len(releases) > maxMessageReleases {
+		releases = releases[len(releases)-maxMessageReleases:]
+	}
+	for _, release := range releases {
+		fmt.Fprintf(&sb, "\nRelease %s", release.Tag)
+		if release.URL != "" {
+			fmt.Fprintf(&sb, " %s", release.URL)
+		}
+		sb.WriteString("\n")
+		if notes := strings.TrimSpace(release.Notes); notes != "" {
+			if len(notes) > maxMessageReleaseNotes {
+				cut := maxMessageReleaseNotes
+				for cut > 0 && !utf8.RuneStart(notes[cut]) {
+					cut--
+				}
+				notes = strings.TrimSpace(notes[:cut]) + "\n..."
+			}
+			sb.WriteString(notes + "\n")
+		}
+	}
+	return sb.String()
+}
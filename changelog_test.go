@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/go-github/v48/github"
+	"github.com/squalus/freshen/flake"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseUpstreamLog(t *testing.T) {
+	commits, err := parseUpstreamLog("aaa 1700000000 first: subject with spaces\nbbb 1700000100 \n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 2 {
+		t.Fatalf("commits=%+v", commits)
+	}
+	if commits[0].Rev != "aaa" || commits[0].Subject != "first: subject with spaces" || commits[0].Time.Unix() != 1700000000 {
+		t.Errorf("commit=%+v", commits[0])
+	}
+	if commits[1].Rev != "bbb" || commits[1].Subject != "" {
+		t.Errorf("commit=%+v", commits[1])
+	}
+}
+
+func TestFormatCommitMessage(t *testing.T) {
+	result := NewUpdateResult()
+	result.changeInput("nixpkgs", "0123456789abcdef", "fedcba9876543210")
+	result.changeInput("other", "aaa", "bbb")
+	changelog := Changelog{Input: "nixpkgs", TotalCommits: 150, CompareURL: "https://github.com/o/r/compare/a...b"}
+	for i := 0; i < maxChangelogCommits; i++ {
+		changelog.Commits = append(changelog.Commits, ChangelogCommit{Rev: fmt.Sprintf("%040d", i), Time: time.Unix(0, 0), Subject: fmt.Sprintf("commit %d", i)})
+	}
+	changelog.Releases = []ChangelogRelease{{Tag: "v1.0", Notes: strings.Repeat("é", maxMessageReleaseNotes)}}
+	result.addChangelog(changelog)
+	result.addChangelog(Changelog{Input: "other", Error: "input type=path is not a git repository"})
+
+	message := FormatCommitMessage("task", result)
+	if !strings.HasPrefix(message, "task: update\n\nnixpkgs: 0123456789ab -> fedcba987654\nhttps://github.com/o/r/compare/a...b\n") {
+		t.Errorf("message=%s", message)
+	}
+	if strings.Count(message, "\n- 0000") != maxMessageCommits {
+		t.Errorf("message=%s", message)
+	}
+	if !strings.Contains(message, "- ... and 130 more commits\n") {
+		t.Errorf("message=%s", message)
+	}
+	if !strings.Contains(message, "\nRelease v1.0\n") || !strings.Contains(message, "é\n...\n") || strings.Contains(message, "�") {
+		t.Errorf("message=%s", message)
+	}
+	if !strings.Contains(message, "other: aaa -> bbb\nchangelog unavailable: input type=path is not a git repository\n") {
+		t.Errorf("message=%s", message)
+	}
+}
+
+func TestFetchChangelog_ManyCommits(t *testing.T) {
+	upstream := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		out, err := runGit(upstream, append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(out)
+	}
+	git("init", "-q", "-b", "main")
+	var revs []string
+	for i := 0; i <= 150; i++ {
+		git("commit", "-q", "--allow-empty", "-m", fmt.Sprintf("commit %d", i))
+		switch i {
+		case 10, 120, 150:
+			git("tag", fmt.Sprintf("v%d", i))
+		}
+		revs = append(revs, git("rev-parse", "HEAD"))
+	}
+	spec := &UpdateSpec{}
+	changelog := Changelog{Input: "lib", OldRev: revs[0], NewRev: revs[150]}
+	if err := spec.fetchChangelog(flake.LockInfo{Type: "git", URL: "file://" + upstream}, &changelog); err != nil {
+		t.Fatal(err)
+	}
+	if changelog.TotalCommits != 150 || len(changelog.Commits) != maxChangelogCommits || changelog.Commits[0].Rev != revs[1] {
+		t.Errorf("total=%d commits=%d", changelog.TotalCommits, len(changelog.Commits))
+	}
+	var tags []string
+	for _, release := range changelog.Releases {
+		tags = append(tags, release.Tag)
+	}
+	if !slices.Equal(tags, []string{"v10", "v120", "v150"}) {
+		t.Errorf("tags=%v", tags)
+	}
+}
+
+func TestFetchGitHubChangelog_Pages(t *testing.T) {
+	// no network: listing the tags of github.com fails fast
+	t.Setenv("GIT_ALLOW_PROTOCOL", "file")
+	var pages []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := r.URL.Query().Get("page")
+		pages = append(pages, page)
+		first := 0
+		if page == "2" {
+			first = maxChangelogCommits
+		} else {
+			w.Header().Set("Link", fmt.Sprintf(`<%s%s?page=2>; rel="next"`, "http://"+r.Host, r.URL.Path))
+		}
+		var commits []string
+		for i := first; i < first+maxChangelogCommits && i < 150; i++ {
+			commits = append(commits, fmt.Sprintf(`{"sha": "%040d", "commit": {"message": "commit %d\n\nbody"}}`, i, i))
+		}
+		fmt.Fprintf(w, `{"html_url": "https://github.com/o/r/compare/a...b", "total_commits": 150, "commits": [%s]}`, strings.Join(commits, ","))
+	}))
+	defer server.Close()
+	client := github.NewClient(nil)
+	baseURL, err := url.Parse(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.BaseURL = baseURL
+	spec := &UpdateSpec{GitHub: client}
+	changelog := Changelog{Input: "lib", OldRev: "a", NewRev: fmt.Sprintf("%040d", 149)}
+	if err := spec.fetchGitHubChangelog(flake.LockInfo{Type: "github", Owner: "o", Repo: "r"}, &changelog); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(pages, []string{"", "2"}) {
+		t.Errorf("pages=%v", pages)
+	}
+	if changelog.TotalCommits != 150 || len(changelog.Commits) != maxChangelogCommits || changelog.Commits[1].Subject != "commit 1" {
+		t.Errorf("total=%d commits=%d second=%+v", changelog.TotalCommits, len(changelog.Commits), changelog.Commits[1])
+	}
+}
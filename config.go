@@ -15,6 +15,8 @@ type FreshenConfig struct {
 type UpdateTask struct {
 	// Name of the update task
 	Name string `json:"name"`
+	// Tags used to select groups of update tasks on the command line
+	Tags []string `json:"tags"`
 	// MainAttrPath for the main build
 	MainAttrPath string `json:"attr_path"`
 	// The flake inputs that the build uses
@@ -23,21 +25,98 @@ type UpdateTask struct {
 	DerivedHashes []UpdateDerivedConfig `json:"derived_hashes"`
 	// AttrPaths of update scripts to be run. Scripts will be executed with the flake root as the working directory.
 	UpdateScripts []UpdateScript `json:"update_scripts"`
+	// Hooks run before the inputs are updated, every time the task runs
+	PreUpdate []UpdateScript `json:"pre_update"`
+	// Hooks run after the inputs, derived hashes and update scripts changed something, before the main build
+	PostUpdate []UpdateScript `json:"post_update"`
+	// Hooks run after the main build and tests passed
+	PostSuccess []UpdateScript `json:"post_success"`
 	// AttrPaths that will test the build
 	Tests []TestConfig `json:"tests"`
 	// Names of other required update tasks. These must all be updated successfully for the task to succeed
 	RequiredUpdateTasks []string `json:"required_update_tasks"`
+	// AutoFixHashMismatch repairs unexpected hash mismatches in the main build and tests. The mismatch is matched
+	// against configured derived hash files and hash literals in .nix files, then the build is retried.
+	AutoFixHashMismatch bool `json:"auto_fix_hash_mismatch"`
+	// What to do when the task fails with all inputs updated. Valid values: [none, one_at_a_time]. Default if not
+	// specified: none. one_at_a_time retries with each input updated on its own and keeps every update that passes.
+	Fallback string `json:"fallback"`
+	// Bisect searches the upstream history of a failing git, github, gitlab or sourcehut input for its newest
+	// revision that passes, and locks the input to it. Implies one_at_a_time when the task has several inputs.
+	Bisect bool `json:"bisect"`
+	// MinAge is the minimum age of a new input revision, e.g. 36h, 3d or 1w. Younger revisions are replaced with the
+	// newest upstream commit, or for inputs that follow tags the highest tag, that is old enough. Otherwise the update
+	// is deferred. Can be overridden per input.
+	MinAge string `json:"min_age"`
+	// Retry policy for the main build
+	Retry *RetryConfig `json:"retry"`
+	// Policies that choose the revision of an input, by input name. Inputs without a policy follow the ref in flake.nix.
+	InputPolicies map[string]InputPolicy `json:"input_policies"`
+}
+
+// InputPolicy chooses which upstream revision an input is locked to. At most one of TagRegex, Semver and Branch is
+// needed. TagRegex and Semver can be combined.
+type InputPolicy struct {
+	// TagRegex locks the input to the highest tag matching this regular expression
+	TagRegex string `json:"tag_regex"`
+	// Semver locks the input to the highest tag that is a version in this range, e.g. "^2.1", "~1.4" or ">=1.2 <2"
+	Semver string `json:"semver"`
+	// Branch locks the input to the head of this branch
+	Branch string `json:"branch"`
+	// MinAge overrides the task's MinAge for this input
+	MinAge string `json:"min_age"`
+	// Deny lists upstream revisions that must not be locked
+	Deny []DenyRule `json:"deny"`
+}
+
+// DenyRule matches upstream revisions that are known to be broken. One of Rev, Tag and Version should be set.
+type DenyRule struct {
+	// Rev is a commit hash or a prefix of one
+	Rev string `json:"rev"`
+	// Tag denies the commit this tag points to
+	Tag string `json:"tag"`
+	// Version denies the commits of all tags that are versions in this range, e.g. ">=2.3.0 <2.3.4"
+	Version string `json:"version"`
+	// Expires is the date (YYYY-MM-DD) from which the rule no longer applies. Optional.
+	Expires string `json:"expires"`
+	// Reason is shown when the rule applies
+	Reason string `json:"reason"`
 }
 
 type UpdateScript struct {
-	// AttrPath is the attr path of the update script
+	// Kind of script. Valid values: [build, develop, repo]. Default if not specified: build. build runs Executable from
+	// the output of AttrPath. develop runs Command in the devShell at AttrPath. repo runs Executable from the flake
+	// root with PATH set to the bin directories of PathAttrs.
+	Kind string `json:"kind"`
+	// AttrPath is the attr path of the update script, or of the devShell for develop. Default for develop if not
+	// specified: the default devShell.
 	AttrPath string `json:"attr_path"`
-	// Executable is the file path of the command to execute, relative to the root of the script output in the Nix store
+	// Executable is the file path of the command to execute, relative to the root of the script output in the Nix
+	// store, or relative to the flake root for repo
 	Executable string `json:"executable"`
 	// Arguments provided to the executable, if any
 	Args []string `json:"args"`
+	// Command and its arguments for develop
+	Command []string `json:"command"`
+	// PathAttrs are built for repo and their bin directories make up PATH. Required for repo.
+	PathAttrs []string `json:"path_attrs"`
 	// When the script should run. Valid values: [on_flake_input_change, always]. Default if not specified: on_flake_input_change.
 	RunMode string `json:"run_mode"`
+	// Sandbox runs the script in new Linux user, mount and network namespaces. Only the copy of the flake root is
+	// writable, the Nix store is read-only, and the home directory, the repository and credentials are hidden.
+	Sandbox bool `json:"sandbox"`
+	// Network allows a sandboxed script to access the network and the Nix daemon
+	Network bool `json:"network"`
+	// How the copy of the flake root is made. Valid values: [git, copy]. Default if not specified: git. git stages
+	// every file in a new git repository, which the script can use. copy clones or copies the files and detects
+	// changes from file metadata and content, which is faster on large repositories.
+	Workspace string `json:"workspace"`
+	// AllowedPaths are glob patterns, relative to the flake root, of the files the script may change. ** matches any
+	// number of directories and a directory allows all files below it. Default if not specified: all files.
+	AllowedPaths []string `json:"allowed_paths"`
+	// What happens to changes outside AllowedPaths. Valid values: [fail, drop]. Default if not specified: fail. drop
+	// discards them with a warning.
+	OnDisallowedPath string `json:"on_disallowed_path"`
 }
 
 // UpdateDerivedConfig describes the update tasks derived from a build
@@ -48,14 +127,46 @@ type UpdateDerivedConfig struct {
 	Filename string `json:"filename"`
 	// When the task should run. Valid values: [on_flake_input_change, always]. Default if not specified: on_flake_input_change.
 	RunMode string `json:"run_mode"`
+	// VerifyReproducible builds the mismatch attrPath a second time and fails the task if the two hashes differ
+	VerifyReproducible bool `json:"verify_reproducible"`
 }
 
 // TestConfig describes tests that will run to verify an update
 type TestConfig struct {
-	// AttrPath to build for the test. The test passes if the build succeeds.
+	// Kind of test. Valid values: [build, run, flake_check, develop]. Default if not specified: build.
+	Kind string `json:"kind"`
+	// AttrPath to build for the test. The test passes if the build succeeds. For run, the app or package to run.
+	// For develop, the development shell. Default for develop: the default shell.
 	AttrPath string `json:"attr_path"`
+	// Executable for run, relative to the root of the AttrPath output in the Nix store. Default if not specified:
+	// the program that nix run picks.
+	Executable string `json:"executable"`
+	// Arguments provided to the executable for run
+	Args []string `json:"args"`
+	// Command and its arguments for develop
+	Command []string `json:"command"`
+	// Checks for flake_check, by name. Each builds checks.<system>.<name>. Default if not specified: nix flake check
+	// on the whole flake.
+	Checks []string `json:"checks"`
+	// ExitCode expected from run and develop. Default: 0.
+	ExitCode int `json:"exit_code"`
+	// OutputRegex must match the combined output of run and develop. Optional.
+	OutputRegex string `json:"output_regex"`
 	// DisableSandbox will turn off the Nix sandbox, e.g. for network access
 	DisableSandbox bool `json:"disable_sandbox"`
+	// Retry policy for the test build
+	Retry *RetryConfig `json:"retry"`
+}
+
+// RetryConfig describes how a failed build is retried
+type RetryConfig struct {
+	// Attempts is the total number of builds, including the first. Default if not specified: 1.
+	Attempts int `json:"attempts"`
+	// Backoff is the wait before the first retry as a Go duration. It doubles after each retry. Default: 10s.
+	Backoff string `json:"backoff"`
+	// Failure classes to retry. Valid values: [evaluation, build, hash_mismatch, fetch, timeout, unknown]. Default
+	// if not specified: [fetch, timeout].
+	RetryOn []string `json:"retry_on"`
 }
 
 // GitConfig is the configuration for a remote git task
@@ -112,3 +112,199 @@ func (f Flake) Build(attrPath string) (output string, err error) {
 type BuildOutput struct {
 	Outputs map[string]string `json:"outputs"`
 }
+
+// LockInput locks an input to flakeRef, for example a specific revision, and writes it to the lock file
+func (f Flake) LockInput(input, flakeRef string) error {
+	nixBin, err := exec.LookPath("nix")
+	if err != nil {
+		return fmt.Errorf("cannot find nix binary on path")
+	}
+	cmd := exec.Cmd{
+		Path:   nixBin,
+		Dir:    f.Path,
+		Args:   []string{"", "flake", "lock", "--override-input", input, flakeRef},
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	if err = cmd.Run(); err != nil {
+		return fmt.Errorf("nix flake lock --override-input: %w", err)
+	}
+	return nil
+}
+
+// Metadata is the output of nix flake metadata for a flake reference
+type Metadata struct {
+	Revision     string `json:"revision"`
+	LastModified uint64 `json:"lastModified"`
+	URL          string `json:"url"`
+}
+
+// RefreshMetadata fetches the latest metadata of a flake reference, bypassing the fetcher cache
+func RefreshMetadata(flakeRef string) (Metadata, error) {
+	nixBin, err := exec.LookPath("nix")
+	if err != nil {
+		return Metadata{}, fmt.Errorf("cannot find nix binary on path")
+	}
+	var stdoutBuf bytes.Buffer
+	cmd := exec.Cmd{
+		Path:   nixBin,
+		Args:   []string{"", "flake", "metadata", "--refresh", "--json", flakeRef},
+		Stdout: &stdoutBuf,
+		Stderr: os.Stderr,
+	}
+	if err = cmd.Run(); err != nil {
+		return Metadata{}, fmt.Errorf("nix flake metadata: %w", err)
+	}
+	var out Metadata
+	if err := json.Unmarshal(stdoutBuf.Bytes(), &out); err != nil {
+		return Metadata{}, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	return out, nil
+}
+
+// CurrentSystem returns the Nix system of this machine, e.g. x86_64-linux
+func CurrentSystem() (string, error) {
+	nixBin, err := exec.LookPath("nix")
+	if err != nil {
+		return "", fmt.Errorf("cannot find nix binary on path")
+	}
+	var stdoutBuf bytes.Buffer
+	cmd := exec.Cmd{
+		Path:   nixBin,
+		Args:   []string{"", "eval", "--impure", "--raw", "--expr", "builtins.currentSystem"},
+		Stdout: &stdoutBuf,
+		Stderr: os.Stderr,
+	}
+	if err = cmd.Run(); err != nil {
+		return "", fmt.Errorf("nix eval builtins.currentSystem: %w", err)
+	}
+	return strings.TrimSpace(stdoutBuf.String()), nil
+}
+
+// Check runs nix flake check on the whole flake
+func (f Flake) Check(sandbox bool) (stdout, stderr string, err error) {
+	nixBin, err := exec.LookPath("nix")
+	if err != nil {
+		return "", "", fmt.Errorf("cannot find nix binary on path")
+	}
+	var stdoutBuf, stderrBuf bytes.Buffer
+	args := []string{"", "flake", "check", "-L"}
+	if !sandbox {
+		args = append(args, "--option", "build-use-sandbox", "false")
+	}
+	cmd := exec.Cmd{
+		Path:   nixBin,
+		Dir:    f.Path,
+		Args:   args,
+		Stdout: io.MultiWriter(os.Stdout, &stdoutBuf),
+		Stderr: io.MultiWriter(os.Stderr, &stderrBuf),
+	}
+	if err = cmd.Run(); err != nil {
+		return stdoutBuf.String(), stderrBuf.String(), fmt.Errorf("nix flake check: %w", err)
+	}
+	return stdoutBuf.String(), stderrBuf.String(), nil
+}
+
+// Run runs the app or package at attrPath with args. Returns the combined output and the exit code. err is only
+// set if the command could not be run at all.
+func (f Flake) Run(attrPath string, args []string) (output string, exitCode int, err error) {
+	nixBin, err := exec.LookPath("nix")
+	if err != nil {
+		return "", 0, fmt.Errorf("cannot find nix binary on path")
+	}
+	return runWithExitCode(exec.Cmd{
+		Path: nixBin,
+		Dir:  f.Path,
+		Args: append([]string{"", "run", "-L", ".#" + attrPath, "--"}, args...),
+	})
+}
+
+// Develop runs command inside the development shell at attrPath, or the default shell if attrPath is empty.
+// Returns the combined output and the exit code. err is only set if the command could not be run at all.
+func (f Flake) Develop(attrPath string, command []string) (output string, exitCode int, err error) {
+	nixBin, err := exec.LookPath("nix")
+	if err != nil {
+		return "", 0, fmt.Errorf("cannot find nix binary on path")
+	}
+	if len(command) == 0 {
+		return "", 0, errors.New("nix develop: empty command")
+	}
+	installable := "."
+	if attrPath != "" {
+		installable = ".#" + attrPath
+	}
+	return runWithExitCode(exec.Cmd{
+		Path: nixBin,
+		Dir:  f.Path,
+		Args: append([]string{"", "develop", "-L", installable, "--command"}, command...),
+	})
+}
+
+// RunExecutable runs an executable in the flake root. Returns the combined output and the exit code. err is only
+// set if the executable could not be run at all.
+func (f Flake) RunExecutable(executable string, args []string) (output string, exitCode int, err error) {
+	return runWithExitCode(exec.Cmd{
+		Path: executable,
+		Dir:  f.Path,
+		Args: append([]string{executable}, args...),
+	})
+}
+
+func runWithExitCode(cmd exec.Cmd) (output string, exitCode int, err error) {
+	var outBuf bytes.Buffer
+	cmd.Stdout = io.MultiWriter(os.Stdout, &outBuf)
+	cmd.Stderr = io.MultiWriter(os.Stderr, &outBuf)
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return outBuf.String(), exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return outBuf.String(), 0, fmt.Errorf("%s: %w", cmd.Path, err)
+	}
+	return outBuf.String(), 0, nil
+}
+
+// ArchiveInfo is the output of nix flake archive --json: the store path of a flake and of its inputs
+type ArchiveInfo struct {
+	Path   string                 `json:"path"`
+	Inputs map[string]ArchiveInfo `json:"inputs"`
+}
+
+// ReadArchiveInfo parses the output of nix flake archive --json
+func ReadArchiveInfo(buf []byte) (ArchiveInfo, error) {
+	var out ArchiveInfo
+	if err := json.Unmarshal(buf, &out); err != nil {
+		return ArchiveInfo{}, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	return out, nil
+}
+
+// InputPaths returns the store paths of the flake's inputs, by input name. Inputs are fetched if needed but
+// nothing is copied.
+func (f Flake) InputPaths() (map[string]string, error) {
+	nixBin, err := exec.LookPath("nix")
+	if err != nil {
+		return nil, fmt.Errorf("cannot find nix binary on path")
+	}
+	var stdoutBuf bytes.Buffer
+	cmd := exec.Cmd{
+		Path:   nixBin,
+		Dir:    f.Path,
+		Args:   []string{"", "flake", "archive", "--json", "--dry-run"},
+		Stdout: &stdoutBuf,
+		Stderr: os.Stderr,
+	}
+	if err = cmd.Run(); err != nil {
+		return nil, fmt.Errorf("nix flake archive: %w", err)
+	}
+	info, err := ReadArchiveInfo(stdoutBuf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]string, len(info.Inputs))
+	for name, input := range info.Inputs {
+		out[name] = input.Path
+	}
+	return out, nil
+}
@@ -29,3 +29,17 @@ func TestFlake_Metadata(t *testing.T) {
 		t.Fatalf("InputRev not equal")
 	}
 }
+
+func TestReadArchiveInfo(t *testing.T) {
+	buf := []byte(`{"inputs":{"nixpkgs":{"inputs":{},"path":"/nix/store/abc-source"},"utils":{"inputs":{"systems":{"inputs":{},"path":"/nix/store/def-source"}},"path":"/nix/store/ghi-source"}},"path":"/nix/store/jkl-source"}`)
+	info, err := ReadArchiveInfo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Path != "/nix/store/jkl-source" || info.Inputs["nixpkgs"].Path != "/nix/store/abc-source" {
+		t.Fatalf("info=%+v", info)
+	}
+	if info.Inputs["utils"].Inputs["systems"].Path != "/nix/store/def-source" {
+		t.Fatalf("info=%+v", info)
+	}
+}
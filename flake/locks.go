@@ -1,8 +1,11 @@
 package flake
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"os"
+	"strings"
 )
 
 type Locks struct {
@@ -10,7 +13,8 @@ type Locks struct {
 }
 
 type LockNode struct {
-	Locked LockInfo `json:"locked"`
+	Locked   LockInfo `json:"locked"`
+	Original LockInfo `json:"original"`
 }
 
 type LockInfo struct {
@@ -18,6 +22,68 @@ type LockInfo struct {
 	LastModified uint64 `json:"lastModified"`
 	NarHash      string `json:"narHash"`
 	Rev          string `json:"rev"`
+	Ref          string `json:"ref"`
+	// Owner and Repo are set for github, gitlab and sourcehut inputs
+	Owner string `json:"owner"`
+	Repo  string `json:"repo"`
+	// Host is set for github, gitlab and sourcehut inputs that do not use the default host
+	Host string `json:"host"`
+	// URL is set for git, tarball and other url based inputs
+	URL string `json:"url"`
+	// ID is set for indirect inputs that are looked up in the flake registry
+	ID string `json:"id"`
+}
+
+// FlakeRef renders the lock info as a flake reference. Use it on an original node to get the reference that
+// flake.nix names.
+func (i LockInfo) FlakeRef() (string, error) {
+	var out string
+	switch i.Type {
+	case "indirect":
+		out = "flake:" + i.ID
+		if i.Ref != "" {
+			out += "/" + i.Ref
+		}
+		if i.Rev != "" {
+			out += "/" + i.Rev
+		}
+		return out, nil
+	case "github", "gitlab", "sourcehut":
+		out = fmt.Sprintf("%s:%s/%s", i.Type, i.Owner, i.Repo)
+		if i.Rev != "" {
+			out += "/" + i.Rev
+		} else if i.Ref != "" {
+			out += "/" + i.Ref
+		}
+		if i.Host != "" {
+			out += "?host=" + i.Host
+		}
+		return out, nil
+	case "git":
+		var params []string
+		if i.Ref != "" {
+			params = append(params, "ref="+i.Ref)
+		}
+		if i.Rev != "" {
+			params = append(params, "rev="+i.Rev)
+		}
+		out = "git+" + strings.TrimPrefix(i.URL, "git+")
+		if len(params) > 0 {
+			sep := "?"
+			if strings.Contains(out, "?") {
+				sep = "&"
+			}
+			out += sep + strings.Join(params, "&")
+		}
+		return out, nil
+	case "tarball", "file":
+		if i.URL == "" {
+			return "", fmt.Errorf("%s input without url", i.Type)
+		}
+		return i.URL, nil
+	default:
+		return "", fmt.Errorf("unsupported input type=%s", i.Type)
+	}
 }
 
 func ReadMetadata(buf []byte) (out Locks, err error) {
@@ -45,3 +111,90 @@ func (m Locks) InputRev(input string) (string, bool) {
 	}
 	return node.Locked.Rev, true
 }
+
+// MergeLocks applies the node changes between base and theirs onto ours. All three are flake.lock contents.
+// A node that was changed differently in ours and theirs is a conflict.
+func MergeLocks(base, ours, theirs []byte) ([]byte, error) {
+	var baseLock, oursLock, theirsLock map[string]json.RawMessage
+	for _, cur := range []struct {
+		buf []byte
+		out *map[string]json.RawMessage
+	}{{base, &baseLock}, {ours, &oursLock}, {theirs, &theirsLock}} {
+		if err := json.Unmarshal(cur.buf, cur.out); err != nil {
+			return nil, err
+		}
+	}
+	baseNodes, err := lockNodes(baseLock)
+	if err != nil {
+		return nil, err
+	}
+	oursNodes, err := lockNodes(oursLock)
+	if err != nil {
+		return nil, err
+	}
+	theirsNodes, err := lockNodes(theirsLock)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]struct{})
+	for name := range baseNodes {
+		names[name] = struct{}{}
+	}
+	for name := range theirsNodes {
+		names[name] = struct{}{}
+	}
+	for name := range names {
+		baseNode, theirsNode, oursNode := baseNodes[name], theirsNodes[name], oursNodes[name]
+		if rawEqual(baseNode, theirsNode) {
+			continue
+		}
+		if !rawEqual(oursNode, baseNode) && !rawEqual(oursNode, theirsNode) {
+			return nil, fmt.Errorf("conflicting changes to lock node=%s", name)
+		}
+		if theirsNode == nil {
+			delete(oursNodes, name)
+		} else {
+			oursNodes[name] = theirsNode
+		}
+	}
+	nodesBuf, err := json.Marshal(oursNodes)
+	if err != nil {
+		return nil, err
+	}
+	oursLock["nodes"] = nodesBuf
+	out, err := json.MarshalIndent(oursLock, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+func lockNodes(lock map[string]json.RawMessage) (map[string]json.RawMessage, error) {
+	out := make(map[string]json.RawMessage)
+	if nodes, ok := lock["nodes"]; ok {
+		if err := json.Unmarshal(nodes, &out); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func rawEqual(a, b json.RawMessage) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	var aBuf, bBuf bytes.Buffer
+	if err := json.Compact(&aBuf, a); err != nil {
+		return false
+	}
+	if err := json.Compact(&bBuf, b); err != nil {
+		return false
+	}
+	return bytes.Equal(aBuf.Bytes(), bBuf.Bytes())
+}
+
+// Node returns the lock node of a root input
+func (m Locks) Node(input string) (LockNode, bool) {
+	node, ok := m.Nodes[input]
+	return node, ok
+}
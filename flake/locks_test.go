@@ -0,0 +1,46 @@
+package flake
+
+import (
+	"strings"
+	"testing"
+)
+
+func testLock(revs map[string]string) []byte {
+	var nodes []string
+	var inputs []string
+	for name, rev := range revs {
+		nodes = append(nodes, `"`+name+`": {"locked": {"rev": "`+rev+`", "type": "github"}}`)
+		inputs = append(inputs, `"`+name+`": "`+name+`"`)
+	}
+	nodes = append(nodes, `"root": {"inputs": {`+strings.Join(inputs, ",")+`}}`)
+	return []byte(`{"nodes": {` + strings.Join(nodes, ",") + `}, "root": "root", "version": 7}`)
+}
+
+func TestMergeLocks(t *testing.T) {
+	base := testLock(map[string]string{"a": "1", "b": "1"})
+	ours := testLock(map[string]string{"a": "2", "b": "1"})
+	theirs := testLock(map[string]string{"a": "1", "b": "2"})
+	merged, err := MergeLocks(base, ours, theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locks, err := ReadMetadata(merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev, _ := locks.InputRev("a"); rev != "2" {
+		t.Fatalf("a rev=%s", rev)
+	}
+	if rev, _ := locks.InputRev("b"); rev != "2" {
+		t.Fatalf("b rev=%s", rev)
+	}
+}
+
+func TestMergeLocks_Conflict(t *testing.T) {
+	base := testLock(map[string]string{"a": "1"})
+	ours := testLock(map[string]string{"a": "2"})
+	theirs := testLock(map[string]string{"a": "3"})
+	if _, err := MergeLocks(base, ours, theirs); err == nil {
+		t.Fatal("expected conflict")
+	}
+}
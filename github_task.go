@@ -23,6 +23,8 @@ import (
 type GitHubTaskRunner struct {
 	Config      *GitConfig
 	tokenSource oauth2.TokenSource
+	// tokenPath is the file the GitHub token was read from
+	tokenPath string
 }
 
 func NewGitHubTaskRunner(config *GitConfig) (*GitHubTaskRunner, error) {
@@ -41,6 +43,7 @@ func NewGitHubTaskRunner(config *GitConfig) (*GitHubTaskRunner, error) {
 		return nil, fmt.Errorf("github token os.ReadFile %w", err)
 	}
 	token := strings.TrimSpace(string(tokenBuf))
+	out.tokenPath = tokenPath
 	out.tokenSource = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
 	return &out, nil
 }
@@ -81,11 +84,30 @@ func (g *GitHubTaskRunner) createBlob(ctx context.Context, path string) (hash st
 	return outBlob.GetSHA(), nil
 }
 
-func (g *GitHubTaskRunner) createTree(ctx context.Context, rootDir string, relativePaths []string, baseHash string) (hash string, err error) {
+// createTree creates a tree on top of baseHash with the changed files of result. Deleted files are sent without a
+// SHA, which removes them from the tree.
+func (g *GitHubTaskRunner) createTree(ctx context.Context, rootDir string, result UpdateResult, baseHash string) (hash string, err error) {
+	relativePaths := result.getPathsChanged()
 	entries := make([]*github.TreeEntry, 0, len(relativePaths))
 	blobType := "blob"
-	mode := "100644"
 	for i, curPath := range relativePaths {
+		mode := "100644"
+		if result.isDeleted(curPath) {
+			log.Printf("deleting filename=%s", curPath)
+			entries = append(entries, &github.TreeEntry{
+				Path: &relativePaths[i],
+				Mode: &mode,
+				Type: &blobType,
+			})
+			continue
+		}
+		info, err := os.Stat(path.Join(rootDir, curPath))
+		if err != nil {
+			return "", fmt.Errorf("os.Stat: %w", err)
+		}
+		if info.Mode().Perm()&0111 != 0 {
+			mode = "100755"
+		}
 		log.Printf("creating blob filename=%s", curPath)
 		blobHash, err := g.createBlob(ctx, path.Join(rootDir, curPath))
 		if err != nil {
@@ -219,7 +241,16 @@ func (g *GitHubTaskRunner) runGitTask(ctx context.Context, name string) error {
 		return fmt.Errorf("ReadAutoUpdateConfig: %w", err)
 	}
 	updateFlake := flake.Flake{Path: tempDir}
-	au := NewUpdateSpec(freshenConfig, updateFlake)
+	au, err := NewUpdateSpec(freshenConfig, updateFlake)
+	if err != nil {
+		return fmt.Errorf("NewUpdateSpec: %w", err)
+	}
+	au.Changelogs = true
+	au.GitHub = g.githubClient(ctx)
+	au.SandboxHidden = []string{g.tokenPath}
+	if credsDir := os.Getenv("CREDENTIALS_DIRECTORY"); credsDir != "" {
+		au.SandboxHidden = append(au.SandboxHidden, credsDir)
+	}
 
 	latestHash, err := g.latestCommitHash(ctx, g.Config.Branch)
 	if err != nil {
@@ -241,7 +272,7 @@ func (g *GitHubTaskRunner) runGitTask(ctx context.Context, name string) error {
 		log.Printf("changed file: %s", pathChanged)
 	}
 
-	treeHash, err := g.createTree(ctx, au.Flake.Path, result.getPathsChanged(), latestHash)
+	treeHash, err := g.createTree(ctx, au.Flake.Path, result, latestHash)
 	if err != nil {
 		return fmt.Errorf("createTree: %w", err)
 	}
@@ -252,7 +283,7 @@ func (g *GitHubTaskRunner) runGitTask(ctx context.Context, name string) error {
 		Name:  &g.Config.Author,
 		Email: &g.Config.Email,
 	}
-	message := fmt.Sprintf("%s: update", name)
+	message := FormatCommitMessage(name, result)
 
 	log.Printf("committing")
 	commitHash, err := g.commit(ctx, latestHash, treeHash, author, message)
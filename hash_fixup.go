@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// maxHashFixups limits how many hash mismatches are repaired for a single build
+const maxHashFixups = 10
+
+// buildWithHashFixup builds attrPath. If the task has AutoFixHashMismatch set, a hash mismatch in the build output
+// is repaired and the build is retried.
+func (a *UpdateSpec) buildWithHashFixup(config *UpdateTask, attrPath string, sandbox bool, retry *RetryConfig, snapshot *Snapshot) (UpdateResult, error) {
+	out := NewUpdateResult()
+	seen := make(map[string]struct{})
+	for i := 0; ; i++ {
+		_, stderr, err := a.buildWithRetry(attrPath, sandbox, retry)
+		if err == nil {
+			return out, nil
+		}
+		if !config.AutoFixHashMismatch {
+			return out, err
+		}
+		mismatch, mismatchErr := FindHashMismatch(stderr)
+		if mismatchErr != nil {
+			return out, err
+		}
+		if _, ok := seen[mismatch.Specified]; ok || i >= maxHashFixups {
+			return out, fmt.Errorf("hash mismatch not resolved drv=%s specified=%s got=%s: %w", mismatch.Drv, mismatch.Specified, mismatch.Got, err)
+		}
+		seen[mismatch.Specified] = struct{}{}
+		changedPath, fixErr := a.fixHashMismatch(mismatch, snapshot)
+		if fixErr != nil {
+			return out, fixErr
+		}
+		log.Printf("name=%s attrPath=%s fixed hash mismatch drv=%s file=%s %s -> %s", config.Name, attrPath, mismatch.Drv, changedPath, mismatch.Specified, mismatch.Got)
+		out.addPath(changedPath)
+		out.changeHash(changedPath, mismatch.Specified, mismatch.Got)
+	}
+}
+
+// fixHashMismatch finds where the specified hash of a mismatch is stored and replaces it with the new hash.
+// Returns the changed path relative to the flake root.
+func (a *UpdateSpec) fixHashMismatch(mismatch HashMismatchResult, snapshot *Snapshot) (string, error) {
+	for _, task := range a.Config.UpdateTasks {
+		for _, derivedConfig := range task.DerivedHashes {
+			hashFilePath := path.Join(a.Flake.Path, derivedConfig.Filename)
+			current, err := readJsonStringFile(hashFilePath)
+			if err != nil || current != mismatch.Specified {
+				continue
+			}
+			if err := snapshot.Save(derivedConfig.Filename); err != nil {
+				return "", fmt.Errorf("snapshot.Save %w", err)
+			}
+			if err := writeJsonStringFile(mismatch.Got, hashFilePath); err != nil {
+				return "", fmt.Errorf("writeJsonStringFile hashFilePath=%s %w", hashFilePath, err)
+			}
+			return derivedConfig.Filename, nil
+		}
+	}
+
+	literalPaths, err := findHashLiteral(a.Flake.Path, mismatch.Specified)
+	if err != nil {
+		return "", fmt.Errorf("findHashLiteral %w", err)
+	}
+	if len(literalPaths) == 0 {
+		return "", fmt.Errorf("unknown hash mismatch drv=%s specified=%s got=%s: add a derived_hashes entry for this fixed-output derivation", mismatch.Drv, mismatch.Specified, mismatch.Got)
+	}
+	if len(literalPaths) > 1 {
+		return "", fmt.Errorf("ambiguous hash mismatch drv=%s specified=%s found in files=%s", mismatch.Drv, mismatch.Specified, strings.Join(literalPaths, ","))
+	}
+	literalPath := literalPaths[0]
+	if err := snapshot.Save(literalPath); err != nil {
+		return "", fmt.Errorf("snapshot.Save %w", err)
+	}
+	fullPath := path.Join(a.Flake.Path, literalPath)
+	buf, err := os.ReadFile(fullPath)
+	if err != nil {
+		return "", err
+	}
+	// keep the encoding the file uses
+	replaced := string(buf)
+	gotForms := hashForms(mismatch.Got)
+	for i, specified := range hashForms(mismatch.Specified) {
+		got := mismatch.Got
+		if i < len(gotForms) {
+			got = gotForms[i]
+		}
+		replaced = strings.ReplaceAll(replaced, quoteHash(specified), quoteHash(got))
+	}
+	if err := os.WriteFile(fullPath, []byte(replaced), 0666); err != nil {
+		return "", fmt.Errorf("os.WriteFile path=%s %w", literalPath, err)
+	}
+	return literalPath, nil
+}
+
+// findHashLiteral returns the .nix files under root that contain hash as a string literal in any of its forms, see
+// hashForms, relative to root
+func findHashLiteral(root, hash string) ([]string, error) {
+	var quoted []string
+	for _, form := range hashForms(hash) {
+		quoted = append(quoted, quoteHash(form))
+	}
+	var out []string
+	err := filepath.WalkDir(root, func(curPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(d.Name(), ".nix") {
+			return nil
+		}
+		buf, err := os.ReadFile(curPath)
+		if err != nil {
+			return err
+		}
+		if !slices.ContainsFunc(quoted, func(q string) bool { return strings.Contains(string(buf), q) }) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, curPath)
+		if err != nil {
+			return err
+		}
+		out = append(out, rel)
+		return nil
+	})
+	return out, err
+}
+
+func quoteHash(hash string) string {
+	return `"` + hash + `"`
+}
+
+// nixBase32Alphabet is the alphabet of Nix's base32 encoding, which leaves out e, o, u and t
+const nixBase32Alphabet = "0123456789abcdfghijklmnpqrsvwxyz"
+
+// hashForms returns the ways a hash can be written in a .nix file. Nix reports mismatches as SRI hashes, e.g.
+// sha256-<base64>, but older expressions often use Nix's base32 or hex, e.g. sha256 = "<base32>". For an SRI hash
+// the forms are the SRI hash, base32 and hex, in this order. Other hashes have only one form.
+func hashForms(hash string) []string {
+	algo, encoded, ok := strings.Cut(hash, "-")
+	if !ok || !slices.Contains([]string{"md5", "sha1", "sha256", "sha512"}, algo) {
+		return []string{hash}
+	}
+	digest, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(digest) == 0 {
+		return []string{hash}
+	}
+	return []string{hash, nixBase32(digest), hex.EncodeToString(digest)}
+}
+
+// nixBase32 encodes bytes like nix-hash --to-base32
+func nixBase32(digest []byte) string {
+	n := (len(digest)*8-1)/5 + 1
+	out := make([]byte, n)
+	for k := range out {
+		bit := (n - 1 - k) * 5
+		i, j := bit/8, bit%8
+		c := int(digest[i]) >> j
+		if i+1 < len(digest) {
+			c |= int(digest[i+1]) << (8 - j)
+		}
+		out[k] = nixBase32Alphabet[c&0x1f]
+	}
+	return string(out)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/squalus/freshen/flake"
+	"os"
+	"path"
+	"slices"
+	"testing"
+)
+
+// sha256 of "" and of "x" in SRI, Nix base32 and hex
+var (
+	emptyHashForms = []string{
+		"sha256-47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=",
+		"0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c73",
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	}
+	xHashForms = []string{
+		"sha256-LXEWQrcmsEQBYnyp+6wy9chTD7GQPMTbAiWHF5IaSIE=",
+		"10a83a91g1r50bdw8g4hn47m7j7m6angpabwc80l9c16nx11cw9d",
+		"2d711642b726b04401627ca9fbac32f5c8530fb1903cc4db02258717921a4881",
+	}
+)
+
+func writeTestFile(t *testing.T, root, relPath, content string) {
+	t.Helper()
+	fullPath := path.Join(root, relPath)
+	if err := os.MkdirAll(path.Dir(fullPath), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fullPath, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHashForms(t *testing.T) {
+	if got := hashForms(emptyHashForms[0]); !slices.Equal(got, emptyHashForms) {
+		t.Errorf("forms=%v", got)
+	}
+	for _, hash := range []string{"0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c73", "sha256-not base64", "foo-YWJj"} {
+		if got := hashForms(hash); !slices.Equal(got, []string{hash}) {
+			t.Errorf("hash=%s forms=%v", hash, got)
+		}
+	}
+}
+
+func TestFixHashMismatch_Forms(t *testing.T) {
+	mismatch := HashMismatchResult{Drv: "/nix/store/abc-src.drv", Specified: emptyHashForms[0], Got: xHashForms[0]}
+	for i, name := range []string{"sri", "base32", "hex"} {
+		t.Run(name, func(t *testing.T) {
+			root := t.TempDir()
+			writeTestFile(t, root, "pkgs/foo.nix", `src = fetchurl { url = "https://example.com/foo.tar.gz"; sha256 = "`+emptyHashForms[i]+`"; };`)
+			writeTestFile(t, root, "pkgs/bar.nix", `src = fetchurl { url = "https://example.com/bar.tar.gz"; sha256 = "`+xHashForms[i]+`"; };`)
+			spec := &UpdateSpec{Flake: flake.Flake{Path: root}, Config: &FreshenConfig{}}
+			changedPath, err := spec.fixHashMismatch(mismatch, NewSnapshot(root))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changedPath != "pkgs/foo.nix" {
+				t.Errorf("changedPath=%s", changedPath)
+			}
+			buf, err := os.ReadFile(path.Join(root, "pkgs/foo.nix"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := `src = fetchurl { url = "https://example.com/foo.tar.gz"; sha256 = "` + xHashForms[i] + `"; };`; string(buf) != want {
+				t.Errorf("foo.nix=%s", buf)
+			}
+		})
+	}
+}
@@ -8,9 +8,12 @@ import (
 
 type HashMismatchResult struct {
 	Specified, Got string
+	// Drv is the store path of the fixed-output derivation that failed, if present in the output
+	Drv string
 }
 
 var (
+	drvRe       = regexp.MustCompile("hash mismatch in fixed-output derivation '([^']*)'")
 	gotRe       = regexp.MustCompile("^.*got:\\s*(.*)\\s*$")
 	specifiedRe = regexp.MustCompile("^.*specified:\\s*(.*)\\s*$")
 )
@@ -45,5 +48,10 @@ func FindHashMismatch(buildOutput string) (HashMismatchResult, error) {
 	}
 	specifiedHash := specifiedMatches[1]
 
-	return HashMismatchResult{Got: gotHash, Specified: specifiedHash}, nil
+	var drv string
+	if drvMatches := drvRe.FindStringSubmatch(lines[mismatchLine]); len(drvMatches) == 2 {
+		drv = drvMatches[1]
+	}
+
+	return HashMismatchResult{Got: gotHash, Specified: specifiedHash, Drv: drv}, nil
 }
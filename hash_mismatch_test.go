@@ -1,8 +1,10 @@
 package main
 
 import (
+	"github.com/squalus/freshen/flake"
 	"os"
 	"path"
+	"strings"
 	"testing"
 )
 
@@ -22,4 +24,56 @@ func TestFindHashMismatch(t *testing.T) {
 	if result.Specified != "sha256-AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=" {
 		t.Fatal("specified hash incorrect")
 	}
+	if result.Drv != "/nix/store/mfjrnj0xlw68j8lx5g6lnv4y90wjmbmc-offline.drv" {
+		t.Fatal("drv incorrect")
+	}
+}
+
+func TestUpdatedDerivedHash_VerifyReproducible(t *testing.T) {
+	const (
+		oldHash   = "sha256-AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+		firstHash = "sha256-If5iev47iRxpVvaB7WrfV1U1xaujUsS/113cprtvaB0="
+	)
+	config := UpdateDerivedConfig{AttrPath: "offline", Filename: "hash.json", VerifyReproducible: true}
+	cases := []struct {
+		name string
+		// hashes that the builds report, in order
+		hashes []string
+		stored string
+		builds int
+		err    string
+	}{
+		{"reproducible", []string{firstHash, firstHash}, oldHash, 2, ""},
+		{"not reproducible", []string{firstHash, "sha256-LXEWQrcmsEQBYnyp+6wy9chTD7GQPMTbAiWHF5IaSIE="}, oldHash, 2, "is not reproducible"},
+		{"unchanged", []string{firstHash, "sha256-LXEWQrcmsEQBYnyp+6wy9chTD7GQPMTbAiWHF5IaSIE="}, firstHash, 1, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			root := t.TempDir()
+			count := path.Join(t.TempDir(), "builds")
+			writeTestFile(t, root, "hashes", strings.Join(c.hashes, "\n"))
+			writeTestFile(t, root, config.Filename, `"`+c.stored+`"`)
+			fakeNix(t, `echo x >> `+count+`
+got=$(sed -n "$(wc -l < `+count+`)p" hashes)
+echo "error: hash mismatch in fixed-output derivation '/nix/store/abc-offline.drv':" >&2
+echo "         specified: `+oldHash+`" >&2
+echo "            got:    $got" >&2
+exit 1`)
+			spec := &UpdateSpec{Flake: flake.Flake{Path: root}}
+			_, err := spec.updatedDerivedHash(config)
+			if c.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+				t.Errorf("err=%v want %s", err, c.err)
+			}
+			buf, err := os.ReadFile(count)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if builds := strings.Count(string(buf), "\n"); builds != c.builds {
+				t.Errorf("builds=%d want=%d", builds, c.builds)
+			}
+		})
+	}
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"github.com/squalus/freshen/flake"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseAge parses a Go duration such as 36h, or a whole number of days or weeks such as 3d or 2w
+func parseAge(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			count, err := strconv.Atoi(n)
+			if err != nil {
+				return 0, fmt.Errorf("bad age %q", s)
+			}
+			return time.Duration(count) * unit, nil
+		}
+	}
+	out, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("bad age %q", s)
+	}
+	return out, nil
+}
+
+// minAge returns the minimum age of a new revision for an input. The input policy takes precedence over the task.
+func (u *UpdateTask) minAge(inputName string) (time.Duration, error) {
+	minAge := u.MinAge
+	if policy, ok := u.InputPolicies[inputName]; ok && policy.MinAge != "" {
+		minAge = policy.MinAge
+	}
+	if minAge == "" {
+		return 0, nil
+	}
+	return parseAge(minAge)
+}
+
+// applyMinAge checks the revision an input was just locked to against the minimum age. A revision that is too new
+// is replaced with the newest upstream commit since the old revision that is old enough, or for an input that follows
+// tags, with the highest allowed tag that is old enough and newer than the old revision. Returns the revision the
+// input is now locked to, or an empty string if there is no such commit and the update should be deferred.
+func (a *UpdateSpec) applyMinAge(config *UpdateTask, inputName string, oldLocks, newLocks flake.Locks) (string, error) {
+	newNode, ok := newLocks.Node(inputName)
+	if !ok {
+		return "", fmt.Errorf("missing input in lock file: %s", inputName)
+	}
+	minAge, err := config.minAge(inputName)
+	if err != nil {
+		return "", err
+	}
+	if minAge == 0 || newNode.Locked.LastModified == 0 {
+		return newNode.Locked.Rev, nil
+	}
+	cutoff := time.Now().Add(-minAge)
+	if !time.Unix(int64(newNode.Locked.LastModified), 0).After(cutoff) {
+		return newNode.Locked.Rev, nil
+	}
+	log.Printf("name=%s inputName=%s rev=%s is younger than min_age=%s", config.Name, inputName, newNode.Locked.Rev, minAge)
+	oldNode, _ := oldLocks.Node(inputName)
+	if policy := config.InputPolicies[inputName]; policy.followsTags() {
+		return a.stepBackTag(config, inputName, policy, oldNode, newNode, cutoff)
+	}
+	commits, err := listUpstreamCommits(newNode.Locked, oldNode.Locked.Rev, newNode.Locked.Rev)
+	if err != nil {
+		log.Printf("name=%s inputName=%s cannot list upstream commits: %s", config.Name, inputName, err)
+		return "", nil
+	}
+	var rev string
+	for _, commit := range commits {
+		if !commit.Time.After(cutoff) {
+			rev = commit.Rev
+		}
+	}
+	if rev == "" {
+		return "", nil
+	}
+	flakeRef, err := upstreamFlakeRef(newNode.Locked, rev)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("name=%s inputName=%s stepping back to rev=%s", config.Name, inputName, rev)
+	if err := a.Flake.LockInput(inputName, flakeRef); err != nil {
+		return "", fmt.Errorf("flake.LockInput: %w", err)
+	}
+	return rev, nil
+}
+
+// stepBackTag locks an input that follows tags to the highest allowed tag committed before cutoff and after the old
+// revision. Returns the locked revision, or an empty string if there is no such tag.
+func (a *UpdateSpec) stepBackTag(config *UpdateTask, inputName string, policy InputPolicy, oldNode, newNode flake.LockNode, cutoff time.Time) (string, error) {
+	allowed, err := policy.allowedTags(inputName, newNode.Locked)
+	if err != nil {
+		log.Printf("name=%s inputName=%s cannot list upstream tags: %s", config.Name, inputName, err)
+		return "", nil
+	}
+	tagTimes, err := upstreamTagTimes(newNode.Locked, allowed)
+	if err != nil {
+		log.Printf("name=%s inputName=%s cannot find upstream tag times: %s", config.Name, inputName, err)
+		return "", nil
+	}
+	oldTime := time.Unix(int64(oldNode.Locked.LastModified), 0)
+	var aged []UpstreamTag
+	for _, tag := range allowed {
+		tagTime, ok := tagTimes[tag.Name]
+		if ok && !tagTime.After(cutoff) && tagTime.After(oldTime) {
+			aged = append(aged, tag)
+		}
+	}
+	tag, err := policy.selectTag(aged)
+	if err != nil {
+		return "", nil
+	}
+	flakeRef, err := tagFlakeRef(newNode.Locked, tag)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("name=%s inputName=%s stepping back to tag=%s rev=%s", config.Name, inputName, tag.Name, tag.Rev)
+	if err := a.Flake.LockInput(inputName, flakeRef); err != nil {
+		return "", fmt.Errorf("flake.LockInput: %w", err)
+	}
+	return tag.Rev, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"github.com/squalus/freshen/flake"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAge(t *testing.T) {
+	cases := map[string]time.Duration{
+		"36h":   36 * time.Hour,
+		"90m":   90 * time.Minute,
+		"3d":    3 * 24 * time.Hour,
+		"2w":    14 * 24 * time.Hour,
+		"0d":    0,
+		"1h30m": 90 * time.Minute,
+	}
+	for s, want := range cases {
+		got, err := parseAge(s)
+		if err != nil || got != want {
+			t.Errorf("age=%s got=%s err=%v want=%s", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "d", "1.5d", "3 days", "1y", "-"} {
+		if _, err := parseAge(s); err == nil {
+			t.Errorf("age=%q want error", s)
+		}
+	}
+}
+
+func TestApplyMinAge(t *testing.T) {
+	now := time.Now()
+	upstream := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		out, err := runGit(upstream, append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(out)
+	}
+	commit := func(age time.Duration, tag string, annotated bool) (string, time.Time) {
+		t.Helper()
+		commitTime := now.Add(-age).Truncate(time.Second)
+		t.Setenv("GIT_COMMITTER_DATE", commitTime.Format(time.RFC3339))
+		t.Setenv("GIT_AUTHOR_DATE", commitTime.Format(time.RFC3339))
+		git("commit", "-q", "--allow-empty", "-m", tag)
+		if annotated {
+			git("tag", "-a", "-m", tag, tag)
+		} else {
+			git("tag", tag)
+		}
+		return git("rev-parse", "HEAD"), commitTime
+	}
+	git("init", "-q", "-b", "main")
+	rev10, time10 := commit(10*24*time.Hour, "v1.0", false)
+	rev11, _ := commit(5*24*time.Hour, "v1.1", false)
+	rev12, _ := commit(3*24*time.Hour, "v1.2", true)
+	rev13, time13 := commit(time.Hour, "v1.3", false)
+
+	lockCalls := path.Join(t.TempDir(), "calls")
+	fakeNix(t, `echo "$@" >> `+lockCalls)
+	spec := &UpdateSpec{Flake: flake.Flake{Path: t.TempDir()}}
+	info := flake.LockInfo{Type: "git", URL: "file://" + upstream}
+	locks := func(rev string, lastModified time.Time) flake.Locks {
+		locked := info
+		locked.Rev = rev
+		locked.LastModified = uint64(lastModified.Unix())
+		return flake.Locks{Nodes: map[string]flake.LockNode{"lib": {Locked: locked, Original: info}}}
+	}
+	oldLocks, newLocks := locks(rev10, time10), locks(rev13, time13)
+
+	cases := []struct {
+		name   string
+		config UpdateTask
+		want   string
+		lock   string
+	}{
+		{"old enough", UpdateTask{MinAge: "30m"}, rev13, ""},
+		{"commits", UpdateTask{MinAge: "2d"}, rev12, "?rev=" + rev12},
+		{"annotated tag", UpdateTask{MinAge: "2d", InputPolicies: map[string]InputPolicy{"lib": {Semver: "^1"}}}, rev12, "?ref=refs/tags/v1.2"},
+		{"tag", UpdateTask{InputPolicies: map[string]InputPolicy{"lib": {Semver: "^1", MinAge: "4d"}}}, rev11, "?ref=refs/tags/v1.1"},
+		// v1.0 is old enough but already locked
+		{"no newer tag", UpdateTask{MinAge: "6d", InputPolicies: map[string]InputPolicy{"lib": {TagRegex: "^v"}}}, "", ""},
+		{"no commit", UpdateTask{MinAge: "1w"}, "", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_ = os.Remove(lockCalls)
+			c.config.Name = "task"
+			rev, err := spec.applyMinAge(&c.config, "lib", oldLocks, newLocks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rev != c.want {
+				t.Errorf("rev=%s want=%s", rev, c.want)
+			}
+			buf, _ := os.ReadFile(lockCalls)
+			if c.lock == "" && len(buf) != 0 {
+				t.Errorf("locked %s", buf)
+			}
+			if c.lock != "" && !strings.Contains(string(buf), "flake lock --override-input lib git+file://"+upstream+c.lock) {
+				t.Errorf("nix calls=%q want lock %s", buf, c.lock)
+			}
+		})
+	}
+}
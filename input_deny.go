@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"github.com/squalus/freshen/flake"
+	"log"
+	"strings"
+	"time"
+)
+
+// active reports whether the rule has not expired yet
+func (d DenyRule) active(now time.Time) (bool, error) {
+	if d.Expires == "" {
+		return true, nil
+	}
+	expires, err := time.Parse(time.DateOnly, d.Expires)
+	if err != nil {
+		return false, fmt.Errorf("deny expires: %w", err)
+	}
+	return now.Before(expires), nil
+}
+
+func (d DenyRule) String() string {
+	var out string
+	switch {
+	case d.Rev != "":
+		out = "rev=" + d.Rev
+	case d.Tag != "":
+		out = "tag=" + d.Tag
+	default:
+		out = "version=" + d.Version
+	}
+	if d.Reason != "" {
+		out += " reason: " + d.Reason
+	}
+	return out
+}
+
+// matchesTag reports whether the rule denies a tag, by name, version range or the commit it points to
+func (d DenyRule) matchesTag(tag UpstreamTag) (bool, error) {
+	if d.Tag != "" && d.Tag == tag.Name {
+		return true, nil
+	}
+	if d.Rev != "" && tag.Rev != "" && strings.HasPrefix(tag.Rev, d.Rev) {
+		return true, nil
+	}
+	if d.Version != "" {
+		versionRange, err := ParseVersionRange(d.Version)
+		if err != nil {
+			return false, fmt.Errorf("deny version: %w", err)
+		}
+		if v, ok := ParseVersion(tag.Name); ok && versionRange.Matches(v) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// deniedTag returns the active rule that denies a tag, if any
+func (p InputPolicy) deniedTag(tag UpstreamTag, now time.Time) (*DenyRule, error) {
+	for i, rule := range p.Deny {
+		active, err := rule.active(now)
+		if err != nil {
+			return nil, err
+		}
+		if !active {
+			continue
+		}
+		matched, err := rule.matchesTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			return &p.Deny[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// deniedRev returns the active rule that denies a revision, if any. tags are only needed for tag and version rules.
+func (p InputPolicy) deniedRev(rev string, tags []UpstreamTag, now time.Time) (*DenyRule, error) {
+	for i, rule := range p.Deny {
+		active, err := rule.active(now)
+		if err != nil {
+			return nil, err
+		}
+		if !active {
+			continue
+		}
+		if rule.Rev != "" && strings.HasPrefix(rev, rule.Rev) {
+			return &p.Deny[i], nil
+		}
+	}
+	for _, tag := range tags {
+		if tag.Rev != rev {
+			continue
+		}
+		rule, err := p.deniedTag(tag, now)
+		if err != nil || rule != nil {
+			return rule, err
+		}
+	}
+	return nil, nil
+}
+
+func (p InputPolicy) hasTagRules() bool {
+	for _, rule := range p.Deny {
+		if rule.Tag != "" || rule.Version != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// applyDenyList checks the revision an input was just locked to against the deny list of its policy. A denied
+// revision is replaced with the newest upstream commit since the old revision that is not denied. Returns the
+// revision the input is now locked to, or an empty string if no commit qualifies, and the deny rule that applied.
+func (a *UpdateSpec) applyDenyList(config *UpdateTask, inputName string, oldLocks flake.Locks, rev string) (string, *DenyRule, error) {
+	policy, ok := config.InputPolicies[inputName]
+	if !ok || len(policy.Deny) == 0 {
+		return rev, nil, nil
+	}
+	newLocks, err := a.Flake.MetadataLocks()
+	if err != nil {
+		return "", nil, fmt.Errorf("flake.MetadataLocks %w", err)
+	}
+	newNode, ok := newLocks.Node(inputName)
+	if !ok {
+		return "", nil, fmt.Errorf("missing input in lock file: %s", inputName)
+	}
+	var tags []UpstreamTag
+	if policy.hasTagRules() {
+		if tags, err = listUpstreamTags(newNode.Locked); err != nil {
+			return "", nil, fmt.Errorf("listUpstreamTags: %w", err)
+		}
+	}
+	now := time.Now()
+	rule, err := policy.deniedRev(rev, tags, now)
+	if err != nil || rule == nil {
+		return rev, nil, err
+	}
+	log.Printf("name=%s inputName=%s rev=%s is denied: %s", config.Name, inputName, rev, rule)
+	if policy.followsTags() {
+		return "", rule, nil
+	}
+
+	oldNode, _ := oldLocks.Node(inputName)
+	commits, err := listUpstreamCommits(newNode.Locked, oldNode.Locked.Rev, rev)
+	if err != nil {
+		log.Printf("name=%s inputName=%s cannot list upstream commits: %s", config.Name, inputName, err)
+		return "", rule, nil
+	}
+	for i := len(commits) - 1; i >= 0; i-- {
+		candidate := commits[i].Rev
+		candidateRule, err := policy.deniedRev(candidate, tags, now)
+		if err != nil {
+			return "", nil, err
+		}
+		if candidateRule != nil {
+			continue
+		}
+		flakeRef, err := upstreamFlakeRef(newNode.Locked, candidate)
+		if err != nil {
+			return "", nil, err
+		}
+		log.Printf("name=%s inputName=%s pinning to rev=%s", config.Name, inputName, candidate)
+		if err := a.Flake.LockInput(inputName, flakeRef); err != nil {
+			return "", nil, fmt.Errorf("flake.LockInput: %w", err)
+		}
+		return candidate, rule, nil
+	}
+	return "", rule, nil
+}
+
+// withoutDenied drops the commits that the deny list of an input's policy denies
+func withoutDenied(config *UpdateTask, inputName string, info flake.LockInfo, commits []UpstreamCommit) ([]UpstreamCommit, error) {
+	policy, ok := config.InputPolicies[inputName]
+	if !ok || len(policy.Deny) == 0 {
+		return commits, nil
+	}
+	var tags []UpstreamTag
+	if policy.hasTagRules() {
+		var err error
+		if tags, err = listUpstreamTags(info); err != nil {
+			return nil, fmt.Errorf("listUpstreamTags: %w", err)
+		}
+	}
+	now := time.Now()
+	var out []UpstreamCommit
+	for _, commit := range commits {
+		rule, err := policy.deniedRev(commit.Rev, tags, now)
+		if err != nil {
+			return nil, err
+		}
+		if rule != nil {
+			log.Printf("name=%s inputName=%s skipping rev=%s denied by %s", config.Name, inputName, commit.Rev, rule)
+			continue
+		}
+		out = append(out, commit)
+	}
+	return out, nil
+}
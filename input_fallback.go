@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+const FallbackNone = "none"
+const FallbackOneAtATime = "one_at_a_time"
+
+// runInputFallback runs the task once per input with only that input updated. Each update that builds and passes
+// the tests is kept and later inputs are tried on top of it. The others are restored and reported as held back. With
+// Bisect set, a failing input is bisected to its newest passing revision instead. With KeepFailed set, a copy of the
+// flake root is kept for each input that fails before it is restored. taskSnapshot adopts the original content of
+// the files changed by the kept updates, so that the task can still be undone as a whole.
+func (a *UpdateSpec) runInputFallback(config *UpdateTask, requiredResult UpdateResult, check bool, taskSnapshot *Snapshot) (UpdateResult, error) {
+	out := NewUpdateResult()
+	out.union(requiredResult)
+	var kept []string
+	for _, inputName := range config.Inputs {
+		inputConfig := *config
+		inputConfig.Inputs = []string{inputName}
+		snapshot, err := a.newTaskSnapshot(&inputConfig)
+		if err != nil {
+			return UpdateResult{}, err
+		}
+		log.Printf("name=%s inputName=%s trying update on its own", config.Name, inputName)
+		result, err := a.runTaskSteps(&inputConfig, requiredResult, check, snapshot)
+		// the content before this input is original for every path that no earlier input changed
+		taskSnapshot.Adopt(snapshot)
+		if err != nil {
+			log.Printf("name=%s inputName=%s failed on its own: %s", config.Name, inputName, err)
+			if a.KeepFailed {
+				failedDir, keepErr := a.keepFailedTree(config, inputName)
+				if keepErr != nil {
+					return UpdateResult{}, fmt.Errorf("inputName=%s keep failed tree: %w", inputName, keepErr)
+				}
+				err = fmt.Errorf("%w (failed tree kept in %s)", err, failedDir)
+			}
+			if restoreErr := snapshot.Restore(); restoreErr != nil {
+				return UpdateResult{}, fmt.Errorf("inputName=%s restore failed: %w", inputName, restoreErr)
+			}
+			if !config.Bisect {
+				out.holdBack(inputName, err.Error())
+				continue
+			}
+			bisectResult, bisectErr := a.bisectInput(&inputConfig, inputName, requiredResult, check, taskSnapshot)
+			if bisectErr != nil {
+				log.Printf("name=%s inputName=%s bisect failed: %s", config.Name, inputName, bisectErr)
+				out.holdBack(inputName, fmt.Sprintf("%s. bisect: %s", err, bisectErr))
+				continue
+			}
+			result = bisectResult
+		}
+		kept = append(kept, inputName)
+		out.union(result)
+	}
+	if len(kept) == 0 {
+		return UpdateResult{}, fmt.Errorf("name=%s every input update failed on its own: held back %s", config.Name, strings.Join(out.getHeldBack(), ","))
+	}
+	log.Printf("name=%s kept inputs=%s held back inputs=%s", config.Name, strings.Join(kept, ","), strings.Join(out.getHeldBack(), ","))
+	return out, nil
+}
+
+// keepFailedTree copies the flake root after an input failed on its own, so it can be inspected after the fallback
+// restored it. Returns the directory of the copy.
+func (a *UpdateSpec) keepFailedTree(config *UpdateTask, inputName string) (string, error) {
+	failedDir, err := os.MkdirTemp("", "freshen-failed-"+inputName+"-")
+	if err != nil {
+		return "", fmt.Errorf("os.MkdirTemp: %w", err)
+	}
+	if err := copyFlakeRoot(a.Flake.Path, failedDir); err != nil {
+		return "", err
+	}
+	log.Printf("name=%s inputName=%s keeping failed tree in %s", config.Name, inputName, failedDir)
+	return failedDir, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/squalus/freshen/flake"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const fallbackTestLock = `{"nodes": {
+  "a": {"locked": {"type": "github", "owner": "o", "repo": "a", "rev": "a-old"}},
+  "b": {"locked": {"type": "github", "owner": "o", "repo": "b", "rev": "b-old"}},
+  "c": {"locked": {"type": "github", "owner": "o", "repo": "c", "rev": "c-old"}},
+  "root": {"inputs": {"a": "a", "b": "b", "c": "c"}}
+}, "root": "root", "version": 7}`
+
+func TestRunInputFallback_KeepFailed(t *testing.T) {
+	// updating a and c works, the new revision of b breaks the build
+	fakeNix(t, `case "$1 $2" in
+"flake lock") sed -i "s/\"$4-old\"/\"$4-new\"/" flake.lock ;;
+"build -L") if grep -q b-new flake.lock; then echo "error: builder for '/nix/store/abc-b.drv' failed with exit code 1" >&2; exit 1; fi ;;
+esac`)
+	config := &UpdateTask{Name: "task", Inputs: []string{"a", "b", "c"}, MainAttrPath: "default", Fallback: FallbackOneAtATime}
+	for _, keepFailed := range []bool{false, true} {
+		root := t.TempDir()
+		writeTestFile(t, root, "flake.lock", fallbackTestLock)
+		spec := &UpdateSpec{Flake: flake.Flake{Path: root}, Config: &FreshenConfig{}, KeepFailed: keepFailed}
+		result, err := spec.runInputFallback(config, NewUpdateResult(), false, NewSnapshot(root))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := os.ReadFile(path.Join(root, "flake.lock"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lock := string(buf)
+		if !strings.Contains(lock, "a-new") || !strings.Contains(lock, "c-new") || strings.Contains(lock, "b-new") {
+			t.Errorf("keepFailed=%v lock=%s", keepFailed, lock)
+		}
+		if !slices.Equal(result.getHeldBack(), []string{"b"}) {
+			t.Errorf("keepFailed=%v heldBack=%v", keepFailed, result.getHeldBack())
+		}
+		reason := result.heldBack["b"]
+		_, failedDir, kept := strings.Cut(reason, "failed tree kept in ")
+		if kept != keepFailed {
+			t.Errorf("keepFailed=%v reason=%s", keepFailed, reason)
+		}
+		if !kept {
+			continue
+		}
+		failedDir = strings.TrimSuffix(failedDir, ")")
+		t.Cleanup(func() {
+			_ = os.RemoveAll(failedDir)
+		})
+		buf, err = os.ReadFile(path.Join(failedDir, "flake.lock"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failedLock := string(buf); !strings.Contains(failedLock, "a-new") || !strings.Contains(failedLock, "b-new") {
+			t.Errorf("failed tree lock=%s", failedLock)
+		}
+	}
+}
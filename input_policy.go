@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"github.com/squalus/freshen/flake"
+	"log"
+	"regexp"
+	"time"
+)
+
+func (p InputPolicy) followsTags() bool {
+	return p.TagRegex != "" || p.Semver != ""
+}
+
+// selectTag returns the highest tag allowed by the policy. Tags that are versions sort by version and above tags
+// that are not.
+func (p InputPolicy) selectTag(tags []UpstreamTag) (UpstreamTag, error) {
+	var tagRe *regexp.Regexp
+	if p.TagRegex != "" {
+		var err error
+		if tagRe, err = regexp.Compile(p.TagRegex); err != nil {
+			return UpstreamTag{}, fmt.Errorf("tag_regex: %w", err)
+		}
+	}
+	var versionRange *VersionRange
+	if p.Semver != "" {
+		parsed, err := ParseVersionRange(p.Semver)
+		if err != nil {
+			return UpstreamTag{}, fmt.Errorf("semver: %w", err)
+		}
+		versionRange = &parsed
+	}
+	var best *UpstreamTag
+	for i, tag := range tags {
+		if tagRe != nil && !tagRe.MatchString(tag.Name) {
+			continue
+		}
+		if versionRange != nil {
+			v, ok := ParseVersion(tag.Name)
+			if !ok || !versionRange.Matches(v) {
+				continue
+			}
+		}
+		if best == nil || tagLess(*best, tag) {
+			best = &tags[i]
+		}
+	}
+	if best == nil {
+		return UpstreamTag{}, fmt.Errorf("no tag matches tag_regex=%q semver=%q", p.TagRegex, p.Semver)
+	}
+	return *best, nil
+}
+
+func tagLess(a, b UpstreamTag) bool {
+	aVersion, aOk := ParseVersion(a.Name)
+	bVersion, bOk := ParseVersion(b.Name)
+	switch {
+	case aOk && bOk:
+		return aVersion.Compare(bVersion) < 0
+	case aOk != bOk:
+		return bOk
+	default:
+		return a.Name < b.Name
+	}
+}
+
+// lockNewest moves an input to the newest revision that the task's policy for it allows. Without a policy the
+// input follows the ref in flake.nix.
+func (a *UpdateSpec) lockNewest(config *UpdateTask, inputName string, oldLocks flake.Locks) error {
+	policy := config.InputPolicies[inputName]
+	if !policy.choosesRef() {
+		if err := a.Flake.UpdateInput(inputName); err != nil {
+			return fmt.Errorf("flake.UpdateInput: %w", err)
+		}
+		return nil
+	}
+	node, ok := oldLocks.Node(inputName)
+	if !ok {
+		return fmt.Errorf("missing input in lock file: %s", inputName)
+	}
+	flakeRef, err := policy.newestFlakeRef(inputName, node)
+	if err != nil {
+		return err
+	}
+	if err := a.Flake.LockInput(inputName, flakeRef); err != nil {
+		return fmt.Errorf("flake.LockInput: %w", err)
+	}
+	return nil
+}
+
+// choosesRef reports whether the policy picks the upstream ref instead of the ref in flake.nix
+func (p InputPolicy) choosesRef() bool {
+	return p.followsTags() || p.Branch != ""
+}
+
+// newestFlakeRef returns a flake reference to the newest upstream revision that the policy allows for an input
+// locked at node. The policy must choose a ref.
+func (p InputPolicy) newestFlakeRef(inputName string, node flake.LockNode) (string, error) {
+	if !p.followsTags() {
+		return upstreamFlakeRef(node.Locked, p.Branch)
+	}
+	allowed, err := p.allowedTags(inputName, node.Locked)
+	if err != nil {
+		return "", err
+	}
+	tag, err := p.selectTag(allowed)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("inputName=%s selected tag=%s rev=%s", inputName, tag.Name, tag.Rev)
+	return tagFlakeRef(node.Locked, tag)
+}
+
+// allowedTags lists the upstream tags of an input that are not denied by the policy
+func (p InputPolicy) allowedTags(inputName string, info flake.LockInfo) ([]UpstreamTag, error) {
+	tags, err := listUpstreamTags(info)
+	if err != nil {
+		return nil, fmt.Errorf("listUpstreamTags: %w", err)
+	}
+	var out []UpstreamTag
+	for _, tag := range tags {
+		rule, err := p.deniedTag(tag, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		if rule != nil {
+			log.Printf("inputName=%s skipping denied tag=%s: %s", inputName, tag.Name, rule)
+			continue
+		}
+		out = append(out, tag)
+	}
+	return out, nil
+}
+
+// tagFlakeRef returns a flake reference to the upstream repository of a locked input at a tag
+func tagFlakeRef(info flake.LockInfo, tag UpstreamTag) (string, error) {
+	ref := tag.Name
+	if info.Type == "git" {
+		ref = "refs/tags/" + tag.Name
+	}
+	return upstreamFlakeRef(info, ref)
+}
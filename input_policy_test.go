@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInputPolicy_selectTag(t *testing.T) {
+	tags := []UpstreamTag{{Name: "v1.9.0"}, {Name: "v2.10.1"}, {Name: "v2.9.0"}, {Name: "v3.0.0"}, {Name: "nightly"}}
+	tag, err := InputPolicy{Semver: "^2"}.selectTag(tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.Name != "v2.10.1" {
+		t.Fatalf("selected tag=%s", tag.Name)
+	}
+	tag, err = InputPolicy{TagRegex: "^v1\\."}.selectTag(tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.Name != "v1.9.0" {
+		t.Fatalf("selected tag=%s", tag.Name)
+	}
+	if _, err := (InputPolicy{Semver: "^4"}).selectTag(tags); err == nil {
+		t.Fatal("expected no match")
+	}
+}
+
+func TestInputPolicy_deniedRev(t *testing.T) {
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	policy := InputPolicy{Deny: []DenyRule{
+		{Rev: "abc123", Expires: "2026-01-01", Reason: "expired"},
+		{Rev: "def456", Reason: "segfaults"},
+		{Version: ">=2.3.0 <2.3.2", Reason: "broken release"},
+	}}
+	tags := []UpstreamTag{{Name: "v2.3.1", Rev: "0123456789"}}
+	cases := map[string]string{
+		"abc123aaaa": "",
+		"def456aaaa": "segfaults",
+		"0123456789": "broken release",
+		"9999999999": "",
+	}
+	for rev, wantReason := range cases {
+		rule, err := policy.deniedRev(rev, tags, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var gotReason string
+		if rule != nil {
+			gotReason = rule.Reason
+		}
+		if gotReason != wantReason {
+			t.Errorf("rev=%s got=%q want=%q", rev, gotReason, wantReason)
+		}
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/alecthomas/kong"
+	"github.com/google/go-github/v48/github"
 	"github.com/squalus/freshen/flake"
+	"golang.org/x/oauth2"
 	"log"
 	"os"
 	"path"
@@ -18,6 +20,8 @@ type Cli struct {
 	globals
 	Update       updateCmd       `cmd:"" help:"Run local update task"`
 	RemoteUpdate RemoteUpdateCmd `cmd:"" help:"Run remote update task"`
+	Outdated     outdatedCmd     `cmd:"" help:"Report inputs that are behind upstream, without building"`
+	SandboxExec  sandboxExecCmd  `cmd:"" name:"sandbox-exec" hidden:"" help:"Run a command in the update script sandbox (internal)"`
 }
 
 func main() {
@@ -28,12 +32,27 @@ func main() {
 }
 
 type updateCmd struct {
-	Name     string `help:"Name of update task to run" required:""`
-	RepoPath string `name:"repo-path" help:"Path of repository root" type:"path"`
-	Check    bool   `help:"Always run all build and test steps (even if no inputs changed)"`
+	Name       []string `help:"Name of update task to run. Accepts glob patterns. Repeatable"`
+	Tag        []string `help:"Run all update tasks with this tag. Repeatable"`
+	All        bool     `help:"Run all update tasks"`
+	RepoPath   string   `name:"repo-path" help:"Path of repository root" type:"path"`
+	Check      bool     `help:"Always run all build and test steps (even if no inputs changed)"`
+	Plan       bool     `help:"Print the order in which update tasks would run and exit"`
+	Jobs       int      `help:"Number of independent update tasks to run at the same time" default:"1"`
+	KeepFailed bool     `name:"keep-failed" help:"Leave the files changed by a failed task in place for debugging"`
+	DryRun     bool     `name:"dry-run" help:"Run in a temporary copy of the repository and print the changes that would be made"`
+	SkipBuilds bool     `name:"skip-builds" help:"With --dry-run, skip the main builds and tests"`
+	Report     string   `help:"Write a JSON report of every task and its steps to this file" type:"path"`
+	Changelog  bool     `help:"Fetch the upstream changelog of each changed input for the report" default:"true" negatable:""`
 }
 
 func (u *updateCmd) Run() error {
+	if len(u.Name) == 0 && len(u.Tag) == 0 && !u.All {
+		return fmt.Errorf("provide --name, --tag or --all")
+	}
+	if u.SkipBuilds && !u.DryRun {
+		return fmt.Errorf("--skip-builds requires --dry-run")
+	}
 	if u.RepoPath == "" {
 		cwd, err := os.Getwd()
 		if err != nil {
@@ -52,10 +71,100 @@ func (u *updateCmd) Run() error {
 	}
 
 	updateFlake := flake.Flake{Path: u.RepoPath}
-	autoUpdate := NewUpdateSpec(autoUpdateConfig, updateFlake)
+	if u.DryRun && !u.Plan {
+		tempDir, err := os.MkdirTemp("", "")
+		if err != nil {
+			return fmt.Errorf("os.MkdirTemp %w", err)
+		}
+		defer func() {
+			_ = os.RemoveAll(tempDir)
+		}()
+		if err := copyFlakeRoot(u.RepoPath, tempDir); err != nil {
+			return fmt.Errorf("copyFlakeRoot %w", err)
+		}
+		log.Printf("dry run in tempDir=%s", tempDir)
+		updateFlake = flake.Flake{Path: tempDir}
+	}
+	autoUpdate, err := NewUpdateSpec(autoUpdateConfig, updateFlake)
+	if err != nil {
+		return fmt.Errorf("NewUpdateSpec %w", err)
+	}
+	autoUpdate.KeepFailed = u.KeepFailed
+	autoUpdate.SkipBuilds = u.SkipBuilds
+	autoUpdate.Changelogs = u.Changelog && u.Report != ""
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+		autoUpdate.GitHub = github.NewClient(oauth2.NewClient(context.Background(), oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})))
+	}
+
+	names, err := autoUpdate.Graph.Select(u.Name, u.Tag, u.All)
+	if err != nil {
+		return err
+	}
+
+	if u.Plan {
+		plan, err := autoUpdate.Graph.Plan(names...)
+		if err != nil {
+			return err
+		}
+		fmt.Print(autoUpdate.Graph.FormatPlan(plan))
+		return nil
+	}
+
+	outcomes, err := autoUpdate.RunUpdateNamesParallel(names, u.Check, u.Jobs)
+	if err != nil {
+		return err
+	}
+	fmt.Print(FormatSummary(outcomes))
+	if u.Report != "" {
+		if err := WriteReport(u.Report, outcomes); err != nil {
+			return fmt.Errorf("WriteReport %w", err)
+		}
+	}
+	if u.DryRun {
+		fmt.Println("Planned changes:")
+		fmt.Print(FormatChanges(outcomes))
+	}
+	if failed := countFailed(outcomes); failed > 0 {
+		return fmt.Errorf("%d of %d update tasks did not succeed", failed, len(outcomes))
+	}
+	return nil
+}
+
+type outdatedCmd struct {
+	RepoPath string `name:"repo-path" help:"Path of repository root" type:"path"`
+	Json     bool   `help:"Print JSON instead of a table"`
+}
 
-	_, err = autoUpdate.RunUpdateName(u.Name, u.Check)
-	return err
+func (o *outdatedCmd) Run() error {
+	if o.RepoPath == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		o.RepoPath = cwd
+	}
+	if err := validateRepoPath(o.RepoPath); err != nil {
+		return fmt.Errorf("validateRepoPath %w", err)
+	}
+	freshenConfig, err := ReadJsonFile[FreshenConfig](path.Join(o.RepoPath, "freshen.json"))
+	if err != nil {
+		return fmt.Errorf("ReadAutoUpdateConfig %w", err)
+	}
+	locks, err := flake.Flake{Path: o.RepoPath}.MetadataLocks()
+	if err != nil {
+		return fmt.Errorf("flake.MetadataLocks %w", err)
+	}
+	outdated := findOutdated(freshenConfig, locks)
+	if o.Json {
+		buf, err := json.MarshalIndent(outdated, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(buf))
+		return nil
+	}
+	fmt.Print(FormatOutdated(outdated))
+	return nil
 }
 
 type RemoteUpdateCmd struct {
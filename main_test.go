@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// captureStdout returns what run prints to stdout
+func captureStdout(t *testing.T, run func() error) (string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	runErr := run()
+	os.Stdout = stdout
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf), runErr
+}
+
+func TestUpdateCmd_DryRun(t *testing.T) {
+	fakeNix(t, hookTestNix)
+	root := t.TempDir()
+	files := map[string]string{
+		"flake.nix":    "{ outputs = _: { }; }",
+		"flake.lock":   fallbackTestLock,
+		"version.txt":  "1.2",
+		"freshen.json": `{"update_tasks": [{"name": "task", "attr_path": "default", "inputs": ["a"], "update_scripts": [{"attr_path": "script", "executable": "sh", "args": ["-c", "echo 1.3 > version.txt"]}]}]}`,
+	}
+	for relPath, content := range files {
+		writeTestFile(t, root, relPath, content)
+	}
+	cmd := updateCmd{Name: []string{"task"}, RepoPath: root, DryRun: true, Jobs: 1}
+	stdout, err := captureStdout(t, cmd.Run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for relPath, content := range files {
+		if buf, err := os.ReadFile(path.Join(root, relPath)); err != nil || string(buf) != content {
+			t.Errorf("%s=%q err=%v changed by the dry run", relPath, buf, err)
+		}
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(files) {
+		t.Errorf("dry run added files to the flake root: %v", entries)
+	}
+	_, changes, ok := strings.Cut(stdout, "Planned changes:\n")
+	if want := "task: input a a-old -> a-new\ntask: file flake.lock\ntask: file version.txt\n"; !ok || changes != want {
+		t.Errorf("stdout=%s want changes=%s", stdout, want)
+	}
+}
+
+func TestUpdateCmd_SkipBuildsRequiresDryRun(t *testing.T) {
+	cmd := updateCmd{All: true, RepoPath: t.TempDir(), SkipBuilds: true}
+	if err := cmd.Run(); err == nil || !strings.Contains(err.Error(), "--skip-builds requires --dry-run") {
+		t.Errorf("err=%v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"github.com/squalus/freshen/flake"
+	"log"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// OutdatedInput compares the locked revision of a task input with the latest upstream revision
+type OutdatedInput struct {
+	Task          string    `json:"task"`
+	Input         string    `json:"input"`
+	LockedRev     string    `json:"locked_rev"`
+	LockedDate    time.Time `json:"locked_date"`
+	LatestRev     string    `json:"latest_rev"`
+	LatestDate    time.Time `json:"latest_date"`
+	BehindSeconds int64     `json:"behind_seconds"`
+	// Error is set if the latest revision could not be found
+	Error string `json:"error,omitempty"`
+}
+
+func (o OutdatedInput) upToDate() bool {
+	return o.Error == "" && o.LockedRev == o.LatestRev
+}
+
+// findOutdated queries the latest upstream revision of every input of every task, as chosen by the task's input
+// policy like an update would. Nothing is built or written.
+func findOutdated(config *FreshenConfig, locks flake.Locks) []OutdatedInput {
+	type latest struct {
+		metadata flake.Metadata
+		err      error
+	}
+	// by flake ref, since tasks can have different policies for the same input
+	cache := make(map[string]latest)
+	var out []OutdatedInput
+	for _, task := range config.UpdateTasks {
+		for _, inputName := range task.Inputs {
+			cur := OutdatedInput{Task: task.Name, Input: inputName}
+			node, ok := locks.Node(inputName)
+			if !ok {
+				cur.Error = "missing input in lock file"
+				out = append(out, cur)
+				continue
+			}
+			cur.LockedRev = node.Locked.Rev
+			cur.LockedDate = time.Unix(int64(node.Locked.LastModified), 0).UTC()
+
+			var flakeRef string
+			var err error
+			if policy := task.InputPolicies[inputName]; policy.choosesRef() {
+				flakeRef, err = policy.newestFlakeRef(inputName, node)
+			} else {
+				flakeRef, err = node.Original.FlakeRef()
+			}
+			if err != nil {
+				cur.Error = err.Error()
+				out = append(out, cur)
+				continue
+			}
+			cached, ok := cache[flakeRef]
+			if !ok {
+				log.Printf("inputName=%s querying flakeRef=%s", inputName, flakeRef)
+				cached.metadata, cached.err = flake.RefreshMetadata(flakeRef)
+				cache[flakeRef] = cached
+			}
+			if cached.err != nil {
+				cur.Error = cached.err.Error()
+				out = append(out, cur)
+				continue
+			}
+			cur.LatestRev = cached.metadata.Revision
+			cur.LatestDate = time.Unix(int64(cached.metadata.LastModified), 0).UTC()
+			if cur.LatestRev != cur.LockedRev {
+				cur.BehindSeconds = int64(cur.LatestDate.Sub(cur.LockedDate).Seconds())
+			}
+			out = append(out, cur)
+		}
+	}
+	return out
+}
+
+// FormatOutdated renders the outdated inputs as a table
+func FormatOutdated(outdated []OutdatedInput) string {
+	var sb strings.Builder
+	tw := tabwriter.NewWriter(&sb, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "TASK\tINPUT\tLOCKED\tLOCKED DATE\tLATEST\tLATEST DATE\tBEHIND")
+	for _, cur := range outdated {
+		if cur.Error != "" {
+			_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t-\t-\terror: %s\n", cur.Task, cur.Input, shortRev(cur.LockedRev), formatDate(cur.LockedDate), cur.Error)
+			continue
+		}
+		behind := "up to date"
+		if !cur.upToDate() {
+			behind = formatAge(time.Duration(cur.BehindSeconds) * time.Second)
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", cur.Task, cur.Input, shortRev(cur.LockedRev), formatDate(cur.LockedDate), shortRev(cur.LatestRev), formatDate(cur.LatestDate), behind)
+	}
+	_ = tw.Flush()
+	return sb.String()
+}
+
+func shortRev(rev string) string {
+	if len(rev) > 12 {
+		return rev[:12]
+	}
+	if rev == "" {
+		return "-"
+	}
+	return rev
+}
+
+func formatDate(t time.Time) string {
+	if t.Unix() == 0 {
+		return "-"
+	}
+	return t.Format(time.DateOnly)
+}
+
+// formatAge renders a duration in days, or hours if shorter than a day
+func formatAge(d time.Duration) string {
+	if d >= 24*time.Hour {
+		return fmt.Sprintf("%dd", int(d/(24*time.Hour)))
+	}
+	return fmt.Sprintf("%dh", int(d/time.Hour))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/squalus/freshen/flake"
+	"strings"
+	"testing"
+)
+
+func TestFindOutdated_InputPolicy(t *testing.T) {
+	upstream := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		out, err := runGit(upstream, append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(out)
+	}
+	git("init", "-q", "-b", "main")
+	git("commit", "-q", "--allow-empty", "-m", "1.0")
+	git("tag", "v1.0")
+	git("commit", "-q", "--allow-empty", "-m", "1.1")
+	git("tag", "v1.1")
+	git("commit", "-q", "--allow-empty", "-m", "2.0")
+	git("tag", "v2.0")
+	git("commit", "-q", "--allow-empty", "-m", "unreleased")
+	// the fake metadata reports the flake ref that was queried as the revision
+	fakeNix(t, `echo "{\"revision\": \"$5\", \"lastModified\": 0}"`)
+
+	info := flake.LockInfo{Type: "git", URL: "file://" + upstream, Ref: "main"}
+	locks := flake.Locks{Nodes: map[string]flake.LockNode{"lib": {Locked: info, Original: info}}}
+	config := &FreshenConfig{UpdateTasks: []UpdateTask{
+		{Name: "branch", Inputs: []string{"lib"}},
+		{Name: "stable", Inputs: []string{"lib"}, InputPolicies: map[string]InputPolicy{"lib": {Semver: "^1"}}},
+		{Name: "none", Inputs: []string{"lib"}, InputPolicies: map[string]InputPolicy{"lib": {TagRegex: "^release-"}}},
+	}}
+	outdated := findOutdated(config, locks)
+	if len(outdated) != 3 {
+		t.Fatalf("outdated=%+v", outdated)
+	}
+	if got := outdated[0].LatestRev; got != "git+file://"+upstream+"?ref=main" {
+		t.Errorf("branch latest=%s", got)
+	}
+	if got := outdated[1].LatestRev; got != "git+file://"+upstream+"?ref=refs/tags/v1.1" {
+		t.Errorf("stable latest=%s", got)
+	}
+	if !strings.Contains(outdated[2].Error, "no tag matches") {
+		t.Errorf("none error=%q", outdated[2].Error)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/squalus/freshen/flake"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// parallelRun schedules independent update tasks concurrently. Each task runs in its own copy of the flake root and
+// its changes are merged back into the flake root when it completes.
+type parallelRun struct {
+	spec  *UpdateSpec
+	check bool
+
+	// mu guards the flake root, generation and written
+	mu sync.Mutex
+	// generation is incremented by every merge into the flake root
+	generation int
+	// written records the generation at which each path was last merged
+	written map[string]int
+}
+
+// taskWorkspace is the copy of the flake root that a task runs in
+type taskWorkspace struct {
+	dir        string
+	generation int
+	baseLock   []byte
+}
+
+// RunUpdateNamesParallel is RunUpdateNames with up to jobs tasks running at the same time. Tasks that share a flake
+// input or a derived hash file are never run at the same time.
+func (a *UpdateSpec) RunUpdateNamesParallel(names []string, check bool, jobs int) ([]TaskOutcome, error) {
+	if jobs <= 1 {
+		return a.RunUpdateNames(names, check)
+	}
+	plan, err := a.Graph.Plan(names...)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("plan=%s jobs=%d", strings.Join(plan, ","), jobs)
+	run := parallelRun{spec: a, check: check, written: make(map[string]int)}
+
+	type completion struct {
+		name    string
+		outcome TaskOutcome
+	}
+	// look up every task before starting any, so that an error cannot leave workers running
+	configs := make(map[string]*UpdateTask, len(plan))
+	for _, taskName := range plan {
+		if configs[taskName], err = a.Graph.Task(taskName); err != nil {
+			return nil, err
+		}
+	}
+	outcomes := make(map[string]TaskOutcome, len(plan))
+	pending := append([]string{}, plan...)
+	running := make(map[string]*UpdateTask)
+	done := make(chan completion)
+
+	for len(pending) > 0 || len(running) > 0 {
+		var stillPending []string
+		for _, taskName := range pending {
+			config := configs[taskName]
+			if len(running) >= jobs || !requiredDone(config, outcomes) || conflictsWithRunning(config, running) {
+				stillPending = append(stillPending, taskName)
+				continue
+			}
+			running[taskName] = config
+			requiredOutcomes := make(map[string]TaskOutcome, len(config.RequiredUpdateTasks))
+			for _, required := range config.RequiredUpdateTasks {
+				requiredOutcomes[required] = outcomes[required]
+			}
+			go func() {
+				done <- completion{name: config.Name, outcome: run.runTask(config, requiredOutcomes)}
+			}()
+		}
+		pending = stillPending
+		if len(running) == 0 {
+			return nil, fmt.Errorf("no runnable update task among pending=%s", strings.Join(pending, ","))
+		}
+		finished := <-done
+		delete(running, finished.name)
+		outcomes[finished.name] = finished.outcome
+	}
+
+	out := make([]TaskOutcome, 0, len(plan))
+	for _, taskName := range plan {
+		out = append(out, outcomes[taskName])
+	}
+	return out, nil
+}
+
+func requiredDone(config *UpdateTask, outcomes map[string]TaskOutcome) bool {
+	for _, required := range config.RequiredUpdateTasks {
+		if _, ok := outcomes[required]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// taskResources lists the flake inputs and files that a task is known to change
+func taskResources(config *UpdateTask) []string {
+	var out []string
+	for _, input := range config.Inputs {
+		out = append(out, "input:"+input)
+	}
+	for _, derivedConfig := range config.DerivedHashes {
+		out = append(out, "file:"+path.Clean(derivedConfig.Filename))
+	}
+	return out
+}
+
+func conflictsWithRunning(config *UpdateTask, running map[string]*UpdateTask) bool {
+	resources := make(map[string]struct{})
+	for _, resource := range taskResources(config) {
+		resources[resource] = struct{}{}
+	}
+	for _, runningConfig := range running {
+		for _, resource := range taskResources(runningConfig) {
+			if _, ok := resources[resource]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// runTask runs one task in its own workspace. requiredOutcomes holds the outcomes of the tasks that config requires.
+func (p *parallelRun) runTask(config *UpdateTask, requiredOutcomes map[string]TaskOutcome) TaskOutcome {
+	workspace, err := p.createWorkspace()
+	if err != nil {
+		return TaskOutcome{Name: config.Name, Status: TaskStatusFailed, Err: fmt.Errorf("createWorkspace: %w", err)}
+	}
+	log.Printf("name=%s workspace=%s", config.Name, workspace.dir)
+
+	taskSpec := *p.spec
+	taskSpec.Flake = flake.Flake{Path: workspace.dir}
+	outcome := taskSpec.runPlannedTask(config, requiredOutcomes, p.check)
+	if outcome.Status == TaskStatusFailed && p.spec.KeepFailed {
+		log.Printf("name=%s keeping failed workspace=%s", config.Name, workspace.dir)
+		return outcome
+	}
+	defer func() {
+		_ = os.RemoveAll(workspace.dir)
+	}()
+	if outcome.Status != TaskStatusUpdated {
+		return outcome
+	}
+	if err := p.mergeWorkspace(workspace, outcome.Result); err != nil {
+		outcome.Status = TaskStatusFailed
+		outcome.Err = fmt.Errorf("mergeWorkspace: %w", err)
+		outcome.Result = NewUpdateResult()
+	}
+	return outcome
+}
+
+func (p *parallelRun) createWorkspace() (*taskWorkspace, error) {
+	dir, err := os.MkdirTemp("", "")
+	if err != nil {
+		return nil, fmt.Errorf("os.MkdirTemp: %w", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := copyFlakeRoot(p.spec.Flake.Path, dir); err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, fmt.Errorf("copyFlakeRoot: %w", err)
+	}
+	baseLock, err := os.ReadFile(path.Join(dir, "flake.lock"))
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, fmt.Errorf("read lock file: %w", err)
+	}
+	return &taskWorkspace{dir: dir, generation: p.generation, baseLock: baseLock}, nil
+}
+
+// mergeWorkspace copies the changed paths of a workspace into the flake root. flake.lock is merged per node. Any
+// other path that was merged by another task since the workspace was created is a conflict, unless both tasks
+// produced the same content.
+func (p *parallelRun) mergeWorkspace(workspace *taskWorkspace, result UpdateResult) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	type mergedFile struct {
+		path string
+		buf  []byte
+		mode os.FileMode
+		// deleted removes the file instead of writing buf
+		deleted bool
+	}
+	var merged []mergedFile
+	for _, changedPath := range result.getPathsChanged() {
+		rootPath := path.Join(p.spec.Flake.Path, changedPath)
+		ours, err := os.ReadFile(rootPath)
+		oursExists := err == nil
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("os.ReadFile %s: %w", changedPath, err)
+		}
+		if result.isDeleted(changedPath) {
+			if !oursExists {
+				continue
+			}
+			if p.written[changedPath] > workspace.generation {
+				return fmt.Errorf("conflicting changes to file=%s", changedPath)
+			}
+			merged = append(merged, mergedFile{path: changedPath, deleted: true})
+			continue
+		}
+		workspacePath := path.Join(workspace.dir, changedPath)
+		theirs, err := os.ReadFile(workspacePath)
+		if err != nil {
+			return fmt.Errorf("os.ReadFile %s: %w", changedPath, err)
+		}
+		info, err := os.Stat(workspacePath)
+		if err != nil {
+			return fmt.Errorf("os.Stat %s: %w", changedPath, err)
+		}
+		if oursExists && bytes.Equal(ours, theirs) {
+			continue
+		}
+		if changedPath == "flake.lock" {
+			theirs, err = flake.MergeLocks(workspace.baseLock, ours, theirs)
+			if err != nil {
+				return fmt.Errorf("flake.MergeLocks: %w", err)
+			}
+		} else if p.written[changedPath] > workspace.generation {
+			return fmt.Errorf("conflicting changes to file=%s", changedPath)
+		}
+		merged = append(merged, mergedFile{path: changedPath, buf: theirs, mode: info.Mode().Perm()})
+	}
+
+	p.generation++
+	for _, file := range merged {
+		rootPath := path.Join(p.spec.Flake.Path, file.path)
+		p.written[file.path] = p.generation
+		if file.deleted {
+			log.Printf("merging deleted file=%s", file.path)
+			if err := os.Remove(rootPath); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("os.Remove %s: %w", file.path, err)
+			}
+			continue
+		}
+		log.Printf("merging file=%s", file.path)
+		if err := os.MkdirAll(path.Dir(rootPath), 0777); err != nil {
+			return fmt.Errorf("os.MkdirAll: %w", err)
+		}
+		if err := os.WriteFile(rootPath, file.buf, file.mode); err != nil {
+			return fmt.Errorf("os.WriteFile %s: %w", file.path, err)
+		}
+	}
+	return nil
+}
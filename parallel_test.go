@@ -0,0 +1,148 @@
+package main
+
+import (
+	"github.com/squalus/freshen/flake"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRunUpdateNamesParallel(t *testing.T) {
+	// builds log when they start and end, and take long enough to overlap
+	buildLog := path.Join(t.TempDir(), "builds")
+	fakeNix(t, `case "$1 $2" in
+"flake lock") sed -i "s/\"$4-old\"/\"$4-new\"/" flake.lock ;;
+"build -L") for attr; do :; done
+  attr=${attr#.#}
+  echo "start $attr" >> `+buildLog+`
+  sleep 0.3
+  echo "end $attr" >> `+buildLog+` ;;
+esac`)
+	root := t.TempDir()
+	writeTestFile(t, root, "flake.lock", fallbackTestLock)
+	// a1 and a2 share input a. b and c share nothing.
+	config := &FreshenConfig{}
+	for name, input := range map[string]string{"a1": "a", "a2": "a", "b": "b", "c": "c"} {
+		config.UpdateTasks = append(config.UpdateTasks, UpdateTask{Name: name, Inputs: []string{input}, MainAttrPath: name})
+	}
+	slices.SortFunc(config.UpdateTasks, func(x, y UpdateTask) int { return strings.Compare(x.Name, y.Name) })
+	graph, err := NewTaskGraph(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := &UpdateSpec{Flake: flake.Flake{Path: root}, Config: config, Graph: graph}
+	outcomes, err := spec.RunUpdateNamesParallel([]string{"a1", "a2", "b", "c"}, false, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := make(map[string]TaskStatus)
+	for _, outcome := range outcomes {
+		statuses[outcome.Name] = outcome.Status
+	}
+	// a2 only runs after a1 merged, so it finds a up to date
+	if statuses["a1"] != TaskStatusUpdated || statuses["a2"] != TaskStatusUnchanged || statuses["b"] != TaskStatusUpdated || statuses["c"] != TaskStatusUpdated {
+		t.Errorf("statuses=%v", statuses)
+	}
+	buf, err := os.ReadFile(path.Join(root, "flake.lock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rev := range []string{"a-new", "b-new", "c-new"} {
+		if !strings.Contains(string(buf), rev) {
+			t.Errorf("merged lock is missing %s: %s", rev, buf)
+		}
+	}
+
+	buf, err = os.ReadFile(buildLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	overlap := func(x, y string) bool {
+		return slices.Index(events, "start "+x) < slices.Index(events, "end "+y) && slices.Index(events, "start "+y) < slices.Index(events, "end "+x)
+	}
+	if !overlap("b", "c") {
+		t.Errorf("independent tasks did not run at the same time: %v", events)
+	}
+}
+
+func TestMergeWorkspace(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, "flake.lock", fallbackTestLock)
+	writeTestFile(t, root, "shared.txt", "base")
+	writeTestFile(t, root, "old.txt", "old")
+	run := parallelRun{spec: &UpdateSpec{Flake: flake.Flake{Path: root}}, written: make(map[string]int)}
+	newWorkspace := func() *taskWorkspace {
+		t.Helper()
+		workspace, err := run.createWorkspace()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = os.RemoveAll(workspace.dir)
+		})
+		return workspace
+	}
+	// edit writes content to shared.txt and updates input in the workspace
+	edit := func(workspace *taskWorkspace, content, input string) UpdateResult {
+		t.Helper()
+		result := NewUpdateResult()
+		writeTestFile(t, workspace.dir, "shared.txt", content)
+		result.addPath("shared.txt")
+		lock := strings.ReplaceAll(string(workspace.baseLock), `"`+input+`-old"`, `"`+input+`-new"`)
+		writeTestFile(t, workspace.dir, "flake.lock", lock)
+		result.addPath("flake.lock")
+		return result
+	}
+	readRoot := func(relPath string) string {
+		t.Helper()
+		buf, err := os.ReadFile(path.Join(root, relPath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf)
+	}
+
+	first, second, same := newWorkspace(), newWorkspace(), newWorkspace()
+	firstResult := edit(first, "first", "a")
+	if err := os.Remove(path.Join(first.dir, "old.txt")); err != nil {
+		t.Fatal(err)
+	}
+	firstResult.deletePath("old.txt")
+	if err := run.mergeWorkspace(first, firstResult); err != nil {
+		t.Fatal(err)
+	}
+	if got := readRoot("shared.txt"); got != "first" {
+		t.Errorf("shared.txt=%s", got)
+	}
+	if _, err := os.Stat(path.Join(root, "old.txt")); !os.IsNotExist(err) {
+		t.Errorf("deleted file not merged: %v", err)
+	}
+
+	// second started before first was merged and changed the same file
+	if err := run.mergeWorkspace(second, edit(second, "second", "b")); err == nil || !strings.Contains(err.Error(), "conflicting changes to file=shared.txt") {
+		t.Errorf("err=%v", err)
+	}
+	if got := readRoot("shared.txt"); got != "first" || strings.Contains(readRoot("flake.lock"), "b-new") {
+		t.Errorf("conflicting merge changed the flake root: shared.txt=%s", got)
+	}
+
+	// the same content is not a conflict, and flake.lock is merged per node
+	if err := run.mergeWorkspace(same, edit(same, "first", "c")); err != nil {
+		t.Fatal(err)
+	}
+	if lock := readRoot("flake.lock"); !strings.Contains(lock, "a-new") || !strings.Contains(lock, "c-new") {
+		t.Errorf("flake.lock=%s", lock)
+	}
+
+	// a workspace created after the merges sees them
+	later := newWorkspace()
+	if err := run.mergeWorkspace(later, edit(later, "later", "b")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readRoot("shared.txt"); got != "later" {
+		t.Errorf("shared.txt=%s", got)
+	}
+}
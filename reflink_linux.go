@@ -0,0 +1,12 @@
+package main
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// reflink makes dest share the data blocks of src. It fails if the filesystem does not support it or the files are
+// on different filesystems.
+func reflink(dest, src *os.File) error {
+	return unix.IoctlFileClone(int(dest.Fd()), int(src.Fd()))
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func reflink(dest, src *os.File) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+type StepKind string
+
+const (
+	StepKindInput        StepKind = "input"
+	StepKindDerivedHash  StepKind = "derived_hash"
+	StepKindUpdateScript StepKind = "update_script"
+	StepKindPreUpdate    StepKind = "pre_update"
+	StepKindPostUpdate   StepKind = "post_update"
+	StepKindPostSuccess  StepKind = "post_success"
+	StepKindBuild        StepKind = "build"
+	StepKindTest         StepKind = "test"
+)
+
+type StepStatus string
+
+const (
+	StepStatusChanged   StepStatus = "changed"
+	StepStatusUnchanged StepStatus = "unchanged"
+	StepStatusHeldBack  StepStatus = "held_back"
+	StepStatusDeferred  StepStatus = "deferred"
+	StepStatusPassed    StepStatus = "passed"
+	StepStatusFailed    StepStatus = "failed"
+)
+
+// StepReport is one step of an update task: an input update, derived hash, script, hook, build or test. A step that
+// is retried, e.g. by the one_at_a_time fallback or bisect, is reported once per attempt.
+type StepReport struct {
+	Kind   StepKind   `json:"kind"`
+	Name   string     `json:"name"`
+	Status StepStatus `json:"status"`
+	// Detail is the change made, or the reason the step failed or was held back
+	Detail          string    `json:"detail,omitempty"`
+	Start           time.Time `json:"start"`
+	DurationSeconds float64   `json:"duration_seconds"`
+}
+
+// taskRecorder collects the steps of one task run. A nil taskRecorder records nothing.
+type taskRecorder struct {
+	steps []StepReport
+}
+
+// add records a step that started at start and has just finished
+func (r *taskRecorder) add(kind StepKind, name string, start time.Time, status StepStatus, detail string) {
+	if r == nil {
+		return
+	}
+	r.steps = append(r.steps, StepReport{
+		Kind:            kind,
+		Name:            name,
+		Status:          status,
+		Detail:          detail,
+		Start:           start.UTC(),
+		DurationSeconds: time.Since(start).Seconds(),
+	})
+}
+
+// addResult records a step that passes unless err is set
+func (r *taskRecorder) addResult(kind StepKind, name string, start time.Time, err error) {
+	if err != nil {
+		r.add(kind, name, start, StepStatusFailed, err.Error())
+		return
+	}
+	r.add(kind, name, start, StepStatusPassed, "")
+}
+
+// addChange records a step that changes files. It is unchanged unless result has changed paths.
+func (r *taskRecorder) addChange(kind StepKind, name string, start time.Time, result UpdateResult, err error) {
+	switch {
+	case err != nil:
+		r.add(kind, name, start, StepStatusFailed, err.Error())
+	case result.empty():
+		r.add(kind, name, start, StepStatusUnchanged, "")
+	default:
+		r.add(kind, name, start, StepStatusChanged, strings.Join(result.getPathsChanged(), ","))
+	}
+}
+
+// Report is written by freshen update --report
+type Report struct {
+	Tasks []TaskReport `json:"tasks"`
+}
+
+// TaskReport describes the run of one update task
+type TaskReport struct {
+	Name            string     `json:"name"`
+	Status          TaskStatus `json:"status"`
+	Error           string     `json:"error,omitempty"`
+	DurationSeconds float64    `json:"duration_seconds"`
+	// Inputs and Hashes include the changes made by the tasks this task requires
+	Inputs   []ChangeReport    `json:"inputs"`
+	Hashes   []ChangeReport    `json:"hashes"`
+	HeldBack map[string]string `json:"held_back,omitempty"`
+	Deferred map[string]string `json:"deferred,omitempty"`
+	// FilesChanged includes FilesAdded and FilesDeleted
+	FilesChanged []string `json:"files_changed"`
+	FilesAdded   []string `json:"files_added"`
+	FilesDeleted []string `json:"files_deleted"`
+	// FilesRejected were changed by update scripts outside their allowed_paths. They are not in FilesChanged.
+	FilesRejected []string `json:"files_rejected"`
+	// Versions, Notes and CommitMessages are reported by update scripts
+	Versions       []ChangeReport `json:"versions"`
+	Notes          []string       `json:"notes,omitempty"`
+	CommitMessages []string       `json:"commit_messages,omitempty"`
+	Changelogs     []Changelog    `json:"changelogs"`
+	Steps          []StepReport   `json:"steps"`
+}
+
+// ChangeReport is the old and new revision of an input, the old and new hash in a derived hash file, or a version
+// reported by an update script
+type ChangeReport struct {
+	Name string `json:"name"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+func NewReport(outcomes []TaskOutcome) Report {
+	out := Report{Tasks: make([]TaskReport, 0, len(outcomes))}
+	for _, outcome := range outcomes {
+		result := outcome.Result
+		task := TaskReport{
+			Name:            outcome.Name,
+			Status:          outcome.Status,
+			DurationSeconds: outcome.Duration.Seconds(),
+			Inputs:          changeReports(result.inputsChanged),
+			Hashes:          changeReports(result.hashesChanged),
+			HeldBack:        result.heldBack,
+			Deferred:        result.deferred,
+			FilesChanged:    result.getPathsChanged(),
+			FilesAdded:      sortedKeys(result.pathsAdded),
+			FilesDeleted:    sortedKeys(result.pathsDeleted),
+			FilesRejected:   sortedKeys(result.pathsRejected),
+			Versions:        changeReports(result.versionsChanged),
+			Notes:           result.notes,
+			CommitMessages:  result.messageFragments,
+			Steps:           result.steps,
+		}
+		if outcome.Err != nil {
+			task.Error = outcome.Err.Error()
+		}
+		task.Changelogs = make([]Changelog, 0, len(result.changelogs))
+		for _, input := range sortedKeys(result.changelogs) {
+			task.Changelogs = append(task.Changelogs, result.changelogs[input])
+		}
+		if task.Steps == nil {
+			task.Steps = []StepReport{}
+		}
+		out.Tasks = append(out.Tasks, task)
+	}
+	return out
+}
+
+func changeReports(changes map[string]valueChange) []ChangeReport {
+	out := make([]ChangeReport, 0, len(changes))
+	for _, name := range sortedKeys(changes) {
+		out = append(out, ChangeReport{Name: name, Old: changes[name].old, New: changes[name].new})
+	}
+	return out
+}
+
+// WriteReport writes the report of outcomes to filePath as JSON
+func WriteReport(filePath string, outcomes []TaskOutcome) error {
+	buf, err := json.MarshalIndent(NewReport(outcomes), "", "  ")
+	if err != nil {
+		return fmt.Errorf("json.Marshal %w", err)
+	}
+	if err := os.WriteFile(filePath, append(buf, '\n'), 0644); err != nil {
+		return fmt.Errorf("os.WriteFile %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNewReport(t *testing.T) {
+	result := NewUpdateResult()
+	result.addPath("flake.lock")
+	result.changeInput("nixpkgs", "aaa", "bbb")
+	result.holdBack("other", "build failed")
+	recorder := &taskRecorder{}
+	start := time.Now()
+	recorder.add(StepKindInput, "nixpkgs", start, StepStatusChanged, "aaa -> bbb")
+	recorder.addResult(StepKindBuild, "default", start, nil)
+	recorder.addChange(StepKindUpdateScript, "updater", start, result, nil)
+	recorder.addResult(StepKindTest, "build:test", start, errors.New("build failure"))
+	result.steps = recorder.steps
+
+	report := NewReport([]TaskOutcome{
+		{Name: "a", Status: TaskStatusUpdated, Result: result, Duration: 2 * time.Second},
+		{Name: "b", Status: TaskStatusSkipped, Err: errors.New("linkedUpdate=a failed")},
+	})
+	if len(report.Tasks) != 2 {
+		t.Fatalf("tasks=%d", len(report.Tasks))
+	}
+	a := report.Tasks[0]
+	if a.DurationSeconds != 2 || len(a.Inputs) != 1 || a.Inputs[0] != (ChangeReport{Name: "nixpkgs", Old: "aaa", New: "bbb"}) {
+		t.Fatalf("task a=%+v", a)
+	}
+	if a.HeldBack["other"] != "build failed" || len(a.FilesChanged) != 1 {
+		t.Fatalf("task a=%+v", a)
+	}
+	wantStatus := []StepStatus{StepStatusChanged, StepStatusPassed, StepStatusChanged, StepStatusFailed}
+	if len(a.Steps) != len(wantStatus) {
+		t.Fatalf("steps=%+v", a.Steps)
+	}
+	for i, step := range a.Steps {
+		if step.Status != wantStatus[i] {
+			t.Errorf("step=%d status=%s want=%s", i, step.Status, wantStatus[i])
+		}
+	}
+	if a.Steps[2].Detail != "flake.lock" || a.Steps[3].Detail != "build failure" {
+		t.Errorf("steps=%+v", a.Steps)
+	}
+	b := report.Tasks[1]
+	if b.Error != "linkedUpdate=a failed" || b.Steps == nil || b.Inputs == nil {
+		t.Fatalf("task b=%+v", b)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+)
+
+// sandboxExecName is the hidden command that sets up the sandbox inside the new namespaces and runs the script
+const sandboxExecName = "sandbox-exec"
+
+// sandboxHome is the home directory in the sandbox. It is on a private tmpfs.
+const sandboxHome = "/tmp"
+
+// sandboxHiddenEnv are environment variables that point to credentials. They are not passed to sandboxed scripts.
+var sandboxHiddenEnv = []string{
+	"CREDENTIALS_DIRECTORY",
+	"GITHUB_TOKEN",
+	"GH_TOKEN",
+	"SSH_AUTH_SOCK",
+	"GNUPGHOME",
+	"XDG_RUNTIME_DIR",
+}
+
+type sandboxExecCmd struct {
+	Root     string   `help:"Empty directory to build the new root in" required:""`
+	Workdir  string   `help:"Directory that stays writable and runs the command" required:""`
+	Writable []string `help:"More directories that stay writable" sep:"none"`
+	Network  bool     `help:"Keep network access"`
+	Hide     []string `help:"Files or directories to cover in the new root" sep:"none"`
+	Replace  []string `help:"Files to cover with another file in the new root, as target=source" sep:"none"`
+	Command  []string `arg:"" passthrough:"" help:"Command to run"`
+}
+
+func (s *sandboxExecCmd) Run() error {
+	return runSandbox(s.Root, s.Workdir, s.Writable, s.Network, s.Hide, s.Replace, s.Command)
+}
+
+// nixConfDir is the directory of the system nix.conf and netrc, which are usually below /etc
+func nixConfDir() string {
+	if dir := os.Getenv("NIX_CONF_DIR"); dir != "" {
+		return dir
+	}
+	return "/etc/nix"
+}
+
+// sandboxNixConf writes a copy of the system nix.conf without access tokens to a temporary file. Returns the path of
+// nix.conf and of the copy, or empty strings if nix.conf has no access tokens.
+func sandboxNixConf() (target, copyPath string, err error) {
+	target = path.Join(nixConfDir(), "nix.conf")
+	buf, err := os.ReadFile(target)
+	if os.IsNotExist(err) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	config := withoutAccessTokens(string(buf))
+	if config == strings.TrimSpace(string(buf)) {
+		return "", "", nil
+	}
+	f, err := os.CreateTemp("", "freshen-nix.conf")
+	if err != nil {
+		return "", "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if _, err := f.WriteString(config + "\n"); err != nil {
+		_ = os.Remove(f.Name())
+		return "", "", err
+	}
+	return target, f.Name(), nil
+}
+
+// sandboxEnv removes the credential variables from env, drops access tokens from NIX_CONFIG and moves HOME to
+// sandboxHome
+func sandboxEnv(env []string) []string {
+	out := make([]string, 0, len(env)+1)
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		if name == "HOME" || isHiddenEnv(name) {
+			continue
+		}
+		if name == "NIX_CONFIG" {
+			value = withoutAccessTokens(value)
+			if value == "" {
+				continue
+			}
+			kv = name + "=" + value
+		}
+		out = append(out, kv)
+	}
+	return append(out, "HOME="+sandboxHome)
+}
+
+// withoutAccessTokens removes the access-tokens settings from a nix.conf
+func withoutAccessTokens(config string) string {
+	var lines []string
+	for _, line := range strings.Split(config, "\n") {
+		setting, _, _ := strings.Cut(line, "=")
+		setting = strings.TrimSpace(setting)
+		if setting == "access-tokens" || setting == "extra-access-tokens" {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+func isHiddenEnv(name string) bool {
+	for _, hidden := range sandboxHiddenEnv {
+		if name == hidden {
+			return true
+		}
+	}
+	return false
+}
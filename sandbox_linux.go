@@ -0,0 +1,367 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// sandboxReadOnlyPaths are bind mounted read-only into the sandbox if they exist. Symlinks are recreated.
+var sandboxReadOnlyPaths = []string{
+	"/nix/store",
+	"/bin",
+	"/sbin",
+	"/usr",
+	"/lib",
+	"/lib32",
+	"/lib64",
+	"/etc",
+	"/run/current-system",
+}
+
+// sandboxNetworkPaths are mounted read-only only if the script has network access. The Nix daemon can fetch from
+// the network on behalf of the script.
+var sandboxNetworkPaths = []string{
+	"/nix/var/nix/daemon-socket",
+	"/run/systemd/resolve",
+}
+
+var sandboxDevices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+// sandboxCmd changes cmd to run in new user, mount and pid namespaces, and a new network namespace unless network is
+// true. The command is re-executed as the sandbox-exec command, which builds a new root from the read-only system
+// paths, cmd.Dir and the directories in writable. Only cmd.Dir and writable stay writable.
+//
+// hidden are files or directories that are covered even if they are below a mounted path. The Nix netrc is always
+// hidden, and nix.conf is covered with a copy without access tokens. Other files below /etc stay readable. cleanup
+// removes the temporary files after cmd finished.
+func sandboxCmd(cmd *exec.Cmd, network bool, writable, hidden []string) (cleanup func(), err error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("os.Executable: %w", err)
+	}
+	rootDir, err := os.MkdirTemp("", "freshen-sandbox")
+	if err != nil {
+		return nil, fmt.Errorf("os.MkdirTemp: %w", err)
+	}
+	nixConf, nixConfCopy, err := sandboxNixConf()
+	if err != nil {
+		_ = os.RemoveAll(rootDir)
+		return nil, fmt.Errorf("sandboxNixConf: %w", err)
+	}
+	cleanup = func() {
+		_ = os.RemoveAll(rootDir)
+		if nixConfCopy != "" {
+			_ = os.Remove(nixConfCopy)
+		}
+	}
+	args := []string{self, sandboxExecName, "--root", rootDir, "--workdir", cmd.Dir}
+	if network {
+		args = append(args, "--network")
+	}
+	for _, dir := range writable {
+		args = append(args, "--writable", dir)
+	}
+	// the mounts show the target of a symlink, so that is what needs to be covered
+	for _, p := range append([]string{path.Join(nixConfDir(), "netrc")}, hidden...) {
+		resolved, err := filepath.EvalSymlinks(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			cleanup()
+			return nil, fmt.Errorf("filepath.EvalSymlinks: %w", err)
+		}
+		args = append(args, "--hide", resolved)
+	}
+	if nixConfCopy != "" {
+		resolved, err := filepath.EvalSymlinks(nixConf)
+		if err != nil {
+			cleanup()
+			return nil, fmt.Errorf("filepath.EvalSymlinks: %w", err)
+		}
+		args = append(args, "--replace", resolved+"="+nixConfCopy)
+	}
+	args = append(args, cmd.Path)
+	cmd.Args = append(args, cmd.Args[1:]...)
+	cmd.Path = self
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = sandboxEnv(cmd.Env)
+	cloneFlags := uintptr(syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID)
+	if !network {
+		cloneFlags |= syscall.CLONE_NEWNET
+	}
+	uid, gid := os.Getuid(), os.Getgid()
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:                 cloneFlags,
+		UidMappings:                []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}},
+		GidMappings:                []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}},
+		GidMappingsEnableSetgroups: false,
+		Pdeathsig:                  syscall.SIGKILL,
+	}
+	return cleanup, nil
+}
+
+// runSandbox runs in the namespaces created by sandboxCmd. It builds the new root in root, switches to it and runs
+// command in workDir. replaced are target=source pairs of files to cover with another file.
+func runSandbox(root, workDir string, writable []string, network bool, hidden, replaced, command []string) error {
+	if len(command) == 0 {
+		return fmt.Errorf("missing command")
+	}
+	if err := setupSandboxRoot(root, append([]string{workDir}, writable...), network, hidden, replaced); err != nil {
+		return fmt.Errorf("setupSandboxRoot: %w", err)
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("prctl PR_SET_NO_NEW_PRIVS: %w", err)
+	}
+	cmd := exec.Cmd{
+		Path:   command[0],
+		Args:   command,
+		Dir:    workDir,
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// report the exit code of the script as our own
+		os.Exit(exitErr.ExitCode())
+	}
+	return err
+}
+
+func setupSandboxRoot(root string, writable []string, network bool, hidden, replaced []string) error {
+	// keep the mounts below out of the parent namespace
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("mount private /: %w", err)
+	}
+	if err := unix.Mount("tmpfs", root, "tmpfs", 0, "mode=0755"); err != nil {
+		return fmt.Errorf("mount tmpfs root: %w", err)
+	}
+	readOnlyPaths := sandboxReadOnlyPaths
+	if network {
+		readOnlyPaths = append(readOnlyPaths, sandboxNetworkPaths...)
+	}
+	for _, src := range readOnlyPaths {
+		if err := bindReadOnly(src, path.Join(root, src)); err != nil {
+			return err
+		}
+	}
+	if err := setupSandboxDev(path.Join(root, "dev")); err != nil {
+		return err
+	}
+	procDir := path.Join(root, "proc")
+	if err := os.MkdirAll(procDir, 0755); err != nil {
+		return err
+	}
+	if err := unix.Mount("proc", procDir, "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		// a fresh proc cannot be mounted if parts of the host proc are hidden, e.g. in containers
+		if err := unix.Mount("/proc", procDir, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("mount proc: %w", err)
+		}
+	}
+	tmpDir := path.Join(root, "tmp")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return err
+	}
+	if err := unix.Mount("tmpfs", tmpDir, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777"); err != nil {
+		return fmt.Errorf("mount tmpfs /tmp: %w", err)
+	}
+	for _, dir := range writable {
+		target := path.Join(root, dir)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		if err := unix.Mount(dir, target, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("bind %s: %w", dir, err)
+		}
+	}
+	// last, so that no later mount uncovers a hidden path
+	for _, p := range hidden {
+		if err := hidePath(path.Join(root, p)); err != nil {
+			return err
+		}
+	}
+	for _, pair := range replaced {
+		target, src, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("replace %s: want target=source", pair)
+		}
+		if err := replaceFile(src, path.Join(root, target)); err != nil {
+			return err
+		}
+	}
+	oldRoot := path.Join(root, ".old-root")
+	if err := os.Mkdir(oldRoot, 0700); err != nil {
+		return err
+	}
+	if err := unix.PivotRoot(root, oldRoot); err != nil {
+		return fmt.Errorf("pivot_root: %w", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+	if err := unix.Unmount("/.old-root", unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmount old root: %w", err)
+	}
+	if err := os.Remove("/.old-root"); err != nil {
+		return err
+	}
+	// nothing else needs to be created in the new root
+	if err := unix.Mount("", "/", "", unix.MS_REMOUNT|unix.MS_RDONLY|unix.MS_BIND, ""); err != nil {
+		return fmt.Errorf("remount / read-only: %w", err)
+	}
+	return nil
+}
+
+// bindReadOnly mounts src read-only at dest. Missing paths are skipped and symlinks are copied as symlinks.
+func bindReadOnly(src, dest string) error {
+	info, err := os.Lstat(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dest)
+	}
+	if err := mountPoint(dest, info.IsDir()); err != nil {
+		return err
+	}
+	if err := unix.Mount(src, dest, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind %s: %w", src, err)
+	}
+	return remountReadOnly(src, dest)
+}
+
+// replaceFile covers the file dest with a read-only bind of src. dest is skipped if it is not in the new root.
+func replaceFile(src, dest string) error {
+	if _, err := os.Stat(dest); os.IsNotExist(err) {
+		return nil
+	}
+	if err := unix.Mount(src, dest, "", unix.MS_BIND, ""); err != nil {
+		return fmt.Errorf("bind %s: %w", src, err)
+	}
+	return remountReadOnly(src, dest)
+}
+
+// remountReadOnly makes the bind of src at dest read-only
+func remountReadOnly(src, dest string) error {
+	// a remount in a user namespace must keep the flags that are locked on the original mount
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dest, &stat); err != nil {
+		return fmt.Errorf("statfs %s: %w", src, err)
+	}
+	flags := uintptr(unix.MS_BIND | unix.MS_REMOUNT | unix.MS_RDONLY)
+	for stFlag, msFlag := range map[int64]uintptr{
+		unix.ST_NOSUID:     unix.MS_NOSUID,
+		unix.ST_NODEV:      unix.MS_NODEV,
+		unix.ST_NOEXEC:     unix.MS_NOEXEC,
+		unix.ST_NOATIME:    unix.MS_NOATIME,
+		unix.ST_NODIRATIME: unix.MS_NODIRATIME,
+		unix.ST_RELATIME:   unix.MS_RELATIME,
+	} {
+		if int64(stat.Flags)&stFlag != 0 {
+			flags |= msFlag
+		}
+	}
+	if err := unix.Mount("", dest, "", flags, ""); err != nil {
+		return fmt.Errorf("remount %s read-only: %w", src, err)
+	}
+	return nil
+}
+
+// hidePath covers dest with an empty read-only directory or with /dev/null. Paths that are not in the new root
+// are skipped.
+func hidePath(dest string) error {
+	info, err := os.Stat(dest)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		if err := unix.Mount("tmpfs", dest, "tmpfs", unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV, "mode=0755"); err != nil {
+			return fmt.Errorf("hide %s: %w", dest, err)
+		}
+		return nil
+	}
+	if err := unix.Mount("/dev/null", dest, "", unix.MS_BIND, ""); err != nil {
+		return fmt.Errorf("hide %s: %w", dest, err)
+	}
+	return nil
+}
+
+// setupSandboxDev creates a minimal /dev with the host device nodes that are safe to share
+func setupSandboxDev(devDir string) error {
+	if err := os.MkdirAll(devDir, 0755); err != nil {
+		return err
+	}
+	if err := unix.Mount("tmpfs", devDir, "tmpfs", unix.MS_NOSUID, "mode=0755"); err != nil {
+		return fmt.Errorf("mount tmpfs /dev: %w", err)
+	}
+	for _, name := range sandboxDevices {
+		src := path.Join("/dev", name)
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		dest := path.Join(devDir, name)
+		if err := mountPoint(dest, false); err != nil {
+			return err
+		}
+		if err := unix.Mount(src, dest, "", unix.MS_BIND, ""); err != nil {
+			return fmt.Errorf("bind %s: %w", src, err)
+		}
+	}
+	for name, target := range map[string]string{
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+	} {
+		if err := os.Symlink(target, path.Join(devDir, name)); err != nil {
+			return err
+		}
+	}
+	shmDir := path.Join(devDir, "shm")
+	if err := os.Mkdir(shmDir, 0755); err != nil {
+		return err
+	}
+	if err := unix.Mount("tmpfs", shmDir, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777"); err != nil {
+		return fmt.Errorf("mount tmpfs /dev/shm: %w", err)
+	}
+	return nil
+}
+
+// mountPoint creates an empty directory or file to mount on
+func mountPoint(dest string, dir bool) error {
+	if dir {
+		return os.MkdirAll(dest, 0755)
+	}
+	if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
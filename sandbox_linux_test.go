@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// sandboxCmd re-executes the test binary as the sandbox-exec command
+	if len(os.Args) > 1 && os.Args[1] == sandboxExecName {
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func runSandboxed(t *testing.T, workDir string, network bool, writable, hidden []string, script string) error {
+	t.Helper()
+	cmd := exec.Cmd{
+		Path:   "/bin/sh",
+		Args:   []string{"/bin/sh", "-c", script},
+		Dir:    workDir,
+		Env:    append(os.Environ(), "CREDENTIALS_DIRECTORY=/run/credentials/freshen"),
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	cleanup, err := sandboxCmd(&cmd, network, writable, hidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	return cmd.Run()
+}
+
+func TestSandboxCmd(t *testing.T) {
+	if err := runSandboxed(t, t.TempDir(), false, nil, nil, "true"); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			t.Fatal(err)
+		}
+		t.Skipf("namespaces not available: %s", err)
+	}
+	hostDir := t.TempDir()
+	secret := path.Join(hostDir, "secret")
+	writeTestFile(t, hostDir, "secret", "secret")
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	workDir := t.TempDir()
+	resultDir := t.TempDir()
+	script := `
+set -e
+echo sandboxed > out.txt
+echo result > ` + path.Join(resultDir, "result.json") + `
+test ! -e ` + secret + ` || exit 10
+test ! -e ` + path.Join(cwd, "go.mod") + ` || exit 11
+test -z "$CREDENTIALS_DIRECTORY" || exit 12
+test "$HOME" = /tmp || exit 13
+if touch /etc/freshen-test 2>/dev/null; then exit 14; fi
+test "$(grep -c : /proc/net/dev)" = 1 || exit 15
+`
+	if err := runSandboxed(t, workDir, false, []string{resultDir}, nil, script); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(path.Join(workDir, "out.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "sandboxed\n" {
+		t.Errorf("out.txt=%q", buf)
+	}
+	if buf, err := os.ReadFile(path.Join(resultDir, "result.json")); err != nil || string(buf) != "result\n" {
+		t.Errorf("result.json=%q err=%v", buf, err)
+	}
+	if _, err := os.Stat("/etc/freshen-test"); err == nil {
+		_ = os.Remove("/etc/freshen-test")
+		t.Error("sandbox wrote to /etc")
+	}
+
+	err = runSandboxed(t, workDir, false, nil, nil, "exit 3")
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Errorf("want exit code 3, got %v", err)
+	}
+}
+
+func TestSandboxEnv(t *testing.T) {
+	env := sandboxEnv([]string{"PATH=/bin", "HOME=/root", "CREDENTIALS_DIRECTORY=/run/credentials/x", "GITHUB_TOKEN=abc", "LANG=C",
+		"NIX_CONFIG=access-tokens = github.com=abc\nexperimental-features = nix-command flakes\nextra-access-tokens=gitlab.com=def"})
+	want := []string{"PATH=/bin", "LANG=C", "NIX_CONFIG=experimental-features = nix-command flakes", "HOME=/tmp"}
+	if got := sandboxEnv([]string{"NIX_CONFIG=access-tokens = github.com=abc"}); len(got) != 1 {
+		t.Errorf("env=%v", got)
+	}
+	if len(env) != len(want) {
+		t.Fatalf("env=%v", env)
+	}
+	for i := range want {
+		if env[i] != want[i] {
+			t.Errorf("env[%d]=%s want=%s", i, env[i], want[i])
+		}
+	}
+}
+
+func TestSandboxCmd_Hidden(t *testing.T) {
+	if err := runSandboxed(t, t.TempDir(), false, nil, nil, "true"); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			t.Fatal(err)
+		}
+		t.Skipf("namespaces not available: %s", err)
+	}
+	// /etc is mounted into every sandbox, like a token file kept there would be
+	entries, err := os.ReadDir("/etc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hiddenDir := ""
+	for _, entry := range entries {
+		if entry.IsDir() {
+			hiddenDir = path.Join("/etc", entry.Name())
+			break
+		}
+	}
+	if hiddenDir == "" {
+		t.Skip("no directory in /etc")
+	}
+	hidden := []string{"/etc/passwd", hiddenDir, "/etc/freshen-missing"}
+	script := `
+set -e
+test -s /etc/passwd && exit 10
+test -z "$(ls -A ` + hiddenDir + `)" || exit 11
+test -d /etc || exit 12
+`
+	if err := runSandboxed(t, t.TempDir(), false, nil, hidden, script); err != nil {
+		t.Fatal(err)
+	}
+	if err := runSandboxed(t, t.TempDir(), false, nil, nil, "test -s /etc/passwd"); err != nil {
+		t.Fatalf("passwd missing without hiding: %v", err)
+	}
+}
+
+func TestSandboxCmd_NixConf(t *testing.T) {
+	if err := runSandboxed(t, t.TempDir(), false, nil, nil, "true"); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			t.Fatal(err)
+		}
+		t.Skipf("namespaces not available: %s", err)
+	}
+	// the work dir is visible in the sandbox, like /etc/nix
+	workDir := t.TempDir()
+	confDir := path.Join(workDir, "nix")
+	writeTestFile(t, confDir, "nix.conf", "substituters = https://cache.example.com\naccess-tokens = github.com=secret\n")
+	writeTestFile(t, confDir, "netrc", "machine cache.example.com password secret\n")
+	t.Setenv("NIX_CONF_DIR", confDir)
+	script := `
+set -e
+grep -q substituters nix/nix.conf || exit 10
+grep -q secret nix/nix.conf && exit 11
+test -s nix/netrc && exit 12
+true
+`
+	if err := runSandboxed(t, workDir, false, nil, nil, script); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := os.ReadFile(path.Join(confDir, "nix.conf")); err != nil || !strings.Contains(string(buf), "access-tokens") {
+		t.Errorf("nix.conf=%q err=%v changed outside the sandbox", buf, err)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+func sandboxCmd(cmd *exec.Cmd, network bool, writable, hidden []string) (cleanup func(), err error) {
+	return nil, fmt.Errorf("sandboxed update scripts are only supported on Linux")
+}
+
+func runSandbox(root, workDir string, writable []string, network bool, hidden, replaced, command []string) error {
+	return fmt.Errorf("sandboxed update scripts are only supported on Linux")
+}
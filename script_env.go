@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// ScriptEnv describes the task an update script or hook runs for. It is exported to the script as environment
+// variables and is the data for templates in its args.
+type ScriptEnv struct {
+	Task string
+	// FlakeRoot is the copy of the flake root that the script runs in
+	FlakeRoot string
+	// ResultFile is where the script can write a ScriptResult
+	ResultFile string
+	// Inputs of the task and inputs changed by required tasks, by input name
+	Inputs map[string]ScriptInput
+	// ChangedInputs are the names of the inputs whose revision changed, sorted
+	ChangedInputs []string
+}
+
+type ScriptInput struct {
+	Name    string
+	OldRev  string
+	NewRev  string
+	Changed bool
+	// StorePath of the input at NewRev
+	StorePath string
+}
+
+// inputPathsCache holds the store paths of the flake inputs for one content of flake.lock. It is shared by the
+// tasks of a parallel run.
+type inputPathsCache struct {
+	mu    sync.Mutex
+	lock  []byte
+	paths map[string]string
+}
+
+// scriptInputPaths returns the store paths of the flake inputs for the script env of a task. They are only looked up
+// if the task has inputs, and again only after flake.lock changed. Finding them fetches every input, so a failure
+// is logged and leaves the store paths empty instead of failing the task.
+func (a *UpdateSpec) scriptInputPaths(config *UpdateTask, current UpdateResult) map[string]string {
+	if len(config.Inputs) == 0 && len(current.inputsChanged) == 0 {
+		return nil
+	}
+	lock, err := os.ReadFile(path.Join(a.Flake.Path, "flake.lock"))
+	if err != nil {
+		lock = nil
+	}
+	if a.inputPaths != nil {
+		a.inputPaths.mu.Lock()
+		defer a.inputPaths.mu.Unlock()
+		if a.inputPaths.paths != nil && bytes.Equal(a.inputPaths.lock, lock) {
+			return a.inputPaths.paths
+		}
+	}
+	paths, err := a.Flake.InputPaths()
+	if err != nil {
+		log.Printf("Cannot find the store paths of the flake inputs name=%s err=%s", config.Name, err)
+		paths = make(map[string]string)
+	}
+	if a.inputPaths != nil {
+		a.inputPaths.lock = lock
+		a.inputPaths.paths = paths
+	}
+	return paths
+}
+
+// newScriptEnv collects the input revisions of a task. current holds the changes made so far. inputPaths are the
+// store paths of the flake inputs.
+func (a *UpdateSpec) newScriptEnv(config *UpdateTask, current UpdateResult, inputPaths map[string]string) (*ScriptEnv, error) {
+	locks, err := a.Flake.MetadataLocks()
+	if err != nil {
+		return nil, fmt.Errorf("flake.MetadataLocks %w", err)
+	}
+	out := &ScriptEnv{Task: config.Name, Inputs: make(map[string]ScriptInput)}
+	for _, inputName := range config.Inputs {
+		rev, _ := locks.InputRev(inputName)
+		out.Inputs[inputName] = ScriptInput{Name: inputName, OldRev: rev, NewRev: rev, StorePath: inputPaths[inputName]}
+	}
+	for _, inputName := range sortedKeys(current.inputsChanged) {
+		change := current.inputsChanged[inputName]
+		out.Inputs[inputName] = ScriptInput{
+			Name:      inputName,
+			OldRev:    change.old,
+			NewRev:    change.new,
+			Changed:   change.old != change.new,
+			StorePath: inputPaths[inputName],
+		}
+	}
+	for _, inputName := range sortedKeys(out.Inputs) {
+		if out.Inputs[inputName].Changed {
+			out.ChangedInputs = append(out.ChangedInputs, inputName)
+		}
+	}
+	return out, nil
+}
+
+// Environ returns the environment variables for the script:
+// FRESHEN_TASK, FRESHEN_FLAKE_ROOT, FRESHEN_RESULT_FILE, FRESHEN_CHANGED_INPUTS (space separated) and, for each input,
+// FRESHEN_INPUT_<NAME>_OLD_REV, FRESHEN_INPUT_<NAME>_NEW_REV, FRESHEN_INPUT_<NAME>_CHANGED (0 or 1) and
+// FRESHEN_INPUT_<NAME>_STORE_PATH. NAME is the input name in upper case with other characters than letters and
+// digits replaced by underscores.
+func (e *ScriptEnv) Environ() []string {
+	out := []string{
+		"FRESHEN_TASK=" + e.Task,
+		"FRESHEN_FLAKE_ROOT=" + e.FlakeRoot,
+		"FRESHEN_RESULT_FILE=" + e.ResultFile,
+		"FRESHEN_CHANGED_INPUTS=" + strings.Join(e.ChangedInputs, " "),
+	}
+	for _, name := range sortedKeys(e.Inputs) {
+		input := e.Inputs[name]
+		prefix := "FRESHEN_INPUT_" + envName(name) + "_"
+		changed := "0"
+		if input.Changed {
+			changed = "1"
+		}
+		out = append(out,
+			prefix+"OLD_REV="+input.OldRev,
+			prefix+"NEW_REV="+input.NewRev,
+			prefix+"CHANGED="+changed,
+			prefix+"STORE_PATH="+input.StorePath,
+		)
+	}
+	return out
+}
+
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// ExpandArgs expands Go templates in args with the environment as data, e.g.
+// {{.Inputs.nixpkgs.NewRev}} or {{(index .Inputs "my-input").StorePath}}
+func (e *ScriptEnv) ExpandArgs(args []string) ([]string, error) {
+	out := make([]string, 0, len(args))
+	for _, arg := range args {
+		if !strings.Contains(arg, "{{") {
+			out = append(out, arg)
+			continue
+		}
+		tmpl, err := template.New("arg").Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return nil, fmt.Errorf("arg template %q: %w", arg, err)
+		}
+		var sb strings.Builder
+		if err := tmpl.Execute(&sb, e); err != nil {
+			return nil, fmt.Errorf("arg template %q: %w", arg, err)
+		}
+		out = append(out, sb.String())
+	}
+	return out, nil
+}
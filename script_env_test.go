@@ -0,0 +1,97 @@
+package main
+
+import (
+	"github.com/squalus/freshen/flake"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func testScriptEnv() *ScriptEnv {
+	return &ScriptEnv{
+		Task:      "task",
+		FlakeRoot: "/tmp/root",
+		Inputs: map[string]ScriptInput{
+			"nixpkgs":   {Name: "nixpkgs", OldRev: "aaa", NewRev: "bbb", Changed: true, StorePath: "/nix/store/abc-source"},
+			"my-input2": {Name: "my-input2", OldRev: "ccc", NewRev: "ccc"},
+		},
+		ChangedInputs: []string{"nixpkgs"},
+	}
+}
+
+func TestScriptEnv_Environ(t *testing.T) {
+	want := []string{
+		"FRESHEN_TASK=task",
+		"FRESHEN_FLAKE_ROOT=/tmp/root",
+		"FRESHEN_RESULT_FILE=",
+		"FRESHEN_CHANGED_INPUTS=nixpkgs",
+		"FRESHEN_INPUT_MY_INPUT2_OLD_REV=ccc",
+		"FRESHEN_INPUT_MY_INPUT2_NEW_REV=ccc",
+		"FRESHEN_INPUT_MY_INPUT2_CHANGED=0",
+		"FRESHEN_INPUT_MY_INPUT2_STORE_PATH=",
+		"FRESHEN_INPUT_NIXPKGS_OLD_REV=aaa",
+		"FRESHEN_INPUT_NIXPKGS_NEW_REV=bbb",
+		"FRESHEN_INPUT_NIXPKGS_CHANGED=1",
+		"FRESHEN_INPUT_NIXPKGS_STORE_PATH=/nix/store/abc-source",
+	}
+	if got := testScriptEnv().Environ(); !slices.Equal(got, want) {
+		t.Fatalf("got=%v\nwant=%v", got, want)
+	}
+}
+
+func TestScriptEnv_ExpandArgs(t *testing.T) {
+	got, err := testScriptEnv().ExpandArgs([]string{
+		"--rev={{.Inputs.nixpkgs.NewRev}}",
+		`{{(index .Inputs "my-input2").OldRev}}`,
+		"{{.Task}}:{{range .ChangedInputs}}{{.}}{{end}}",
+		"plain",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"--rev=bbb", "ccc", "task:nixpkgs", "plain"}; !slices.Equal(got, want) {
+		t.Fatalf("got=%v want=%v", got, want)
+	}
+	if _, err := testScriptEnv().ExpandArgs([]string{"{{.Inputs.missing.NewRev}}"}); err == nil {
+		t.Fatal("expected error for missing input")
+	}
+	if _, err := testScriptEnv().ExpandArgs([]string{"{{.Unknown}}"}); err == nil {
+		t.Fatal("expected error for unknown field")
+	}
+}
+
+func TestUpdateSpec_scriptInputPaths(t *testing.T) {
+	root := t.TempDir()
+	calls := path.Join(t.TempDir(), "calls")
+	fakeNix(t, `echo "$@" >> `+calls+`
+echo '{"path": "/nix/store/abc-source", "inputs": {"foo": {"path": "/nix/store/def-source", "inputs": {}}}}'`)
+	writeTestFile(t, root, "flake.lock", "1")
+	spec := &UpdateSpec{Flake: flake.Flake{Path: root}, inputPaths: &inputPathsCache{}}
+	config := &UpdateTask{Name: "task", Inputs: []string{"foo"}}
+
+	if paths := spec.scriptInputPaths(&UpdateTask{Name: "scripts-only"}, NewUpdateResult()); paths != nil {
+		t.Errorf("paths=%v for a task without inputs", paths)
+	}
+	for range 2 {
+		if paths := spec.scriptInputPaths(config, NewUpdateResult()); paths["foo"] != "/nix/store/def-source" {
+			t.Errorf("paths=%v", paths)
+		}
+	}
+	writeTestFile(t, root, "flake.lock", "2")
+	spec.scriptInputPaths(config, NewUpdateResult())
+	buf, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(buf), "flake archive"); got != 2 {
+		t.Errorf("nix flake archive ran %d times, want once per flake.lock", got)
+	}
+
+	fakeNix(t, "exit 1")
+	writeTestFile(t, root, "flake.lock", "3")
+	if paths := spec.scriptInputPaths(config, NewUpdateResult()); paths == nil || paths["foo"] != "" {
+		t.Errorf("paths=%v after failure", paths)
+	}
+}
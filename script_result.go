@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// scriptResultMarker starts a line of script output that holds a ScriptResult as JSON
+const scriptResultMarker = "::freshen-result::"
+
+// scriptResultFile is the name of the file FRESHEN_RESULT_FILE points to. It is in its own temporary directory, so a
+// file of the same name in the flake root is not mistaken for a result.
+const scriptResultFile = ".freshen-result.json"
+
+// ScriptResult is what an update script reports about its changes
+type ScriptResult struct {
+	Versions []VersionChange `json:"versions"`
+	// Notes for the report and commit message, e.g. "foo 1.3 drops support for bar"
+	Notes []string `json:"notes"`
+	// CommitMessage is a paragraph for the commit message
+	CommitMessage string `json:"commit_message"`
+}
+
+// VersionChange is a version bumped by an update script, e.g. a package or dependency version
+type VersionChange struct {
+	Name string `json:"name"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+func parseScriptResult(buf []byte) (ScriptResult, error) {
+	var out ScriptResult
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&out); err != nil {
+		return ScriptResult{}, fmt.Errorf("json.Decode: %w", err)
+	}
+	for _, version := range out.Versions {
+		if version.Name == "" {
+			return ScriptResult{}, fmt.Errorf("version change without name")
+		}
+	}
+	return out, nil
+}
+
+// readScriptResult reads the result file. A missing file is no result.
+func readScriptResult(filePath string) ([]ScriptResult, error) {
+	buf, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile: %w", err)
+	}
+	result, err := parseScriptResult(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", scriptResultFile, err)
+	}
+	return []ScriptResult{result}, nil
+}
+
+// resultWriter passes script output through to w and parses the lines that start with scriptResultMarker
+type resultWriter struct {
+	w       io.Writer
+	line    []byte
+	skip    bool
+	results []ScriptResult
+	err     error
+}
+
+func (r *resultWriter) Write(p []byte) (int, error) {
+	n, err := r.w.Write(p)
+	for _, c := range p[:n] {
+		if c == '\n' {
+			r.endLine()
+			continue
+		}
+		if r.skip {
+			continue
+		}
+		r.line = append(r.line, c)
+		// only lines that start with the marker are kept
+		if len(r.line) <= len(scriptResultMarker) && !strings.HasPrefix(scriptResultMarker, string(r.line)) {
+			r.skip = true
+			r.line = r.line[:0]
+		}
+	}
+	return n, err
+}
+
+func (r *resultWriter) endLine() {
+	if !r.skip && bytes.HasPrefix(r.line, []byte(scriptResultMarker)) && r.err == nil {
+		result, err := parseScriptResult(r.line[len(scriptResultMarker):])
+		if err != nil {
+			r.err = fmt.Errorf("script result line: %w", err)
+		} else {
+			r.results = append(r.results, result)
+		}
+	}
+	r.line = r.line[:0]
+	r.skip = false
+}
+
+// Results returns the results printed by the script, including a last line without a newline
+func (r *resultWriter) Results() ([]ScriptResult, error) {
+	r.endLine()
+	return r.results, r.err
+}
+
+func (u *UpdateResult) addScriptResult(result ScriptResult) {
+	for _, version := range result.Versions {
+		u.changeVersion(version.Name, version.Old, version.New)
+	}
+	for _, note := range result.Notes {
+		u.addNote(note)
+	}
+	if fragment := strings.TrimSpace(result.CommitMessage); fragment != "" {
+		u.addMessageFragment(fragment)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResultWriter(t *testing.T) {
+	var passed bytes.Buffer
+	w := &resultWriter{w: &passed}
+	output := "updating foo\n::freshen-result::{\"versions\": [{\"name\": \"foo\", \"old\": \"1.2\", \"new\": \"1.3\"}]}\n" +
+		"not ::freshen-result::{}\n::freshen-result::{\"notes\": [\"foo 1.3 drops bar\"]}"
+	// split writes in the middle of the marker
+	for _, chunk := range []string{output[:20], output[20:]} {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if passed.String() != output {
+		t.Errorf("passed=%q", passed.String())
+	}
+	results, err := w.Results()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Versions[0] != (VersionChange{Name: "foo", Old: "1.2", New: "1.3"}) || results[1].Notes[0] != "foo 1.3 drops bar" {
+		t.Errorf("results=%+v", results)
+	}
+
+	w = &resultWriter{w: &passed}
+	_, _ = w.Write([]byte("::freshen-result::{\"version\": []}\n"))
+	if _, err := w.Results(); err == nil {
+		t.Error("want error for unknown field")
+	}
+}
+
+func TestRunUpdateScript_ResultFile(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, "version.txt", "1.2")
+	// not a result, just a file in the repository
+	writeTestFile(t, root, scriptResultFile, "[1, 2]")
+	script := UpdateScript{
+		Executable: "sh",
+		Args: []string{"-c", `echo 1.3 > version.txt
+echo '{"versions": [{"name": "foo", "old": "1.2", "new": "1.3"}], "commit_message": "Bump foo to 1.3"}' > "$FRESHEN_RESULT_FILE"
+echo '::freshen-result::{"notes": ["check the changelog"]}'`},
+	}
+	result, err := RunUpdateScript(ScriptBuild{Output: "/bin"}, &script, root, &ScriptEnv{}, NewSnapshot(root), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := result.getPathsChanged(); !slices.Equal(got, []string{"version.txt"}) {
+		t.Errorf("changed=%v", got)
+	}
+	if buf, err := os.ReadFile(path.Join(root, scriptResultFile)); err != nil || string(buf) != "[1, 2]" {
+		t.Errorf("%s=%q err=%v", scriptResultFile, buf, err)
+	}
+	message := FormatCommitMessage("task", result)
+	want := "task: update\n\nBump foo to 1.3\n\nfoo: 1.2 -> 1.3\n\nNotes:\n- check the changelog\n"
+	if message != want {
+		t.Errorf("message=%q want=%q", message, want)
+	}
+	report := NewReport([]TaskOutcome{{Name: "task", Status: TaskStatusUpdated, Result: result}})
+	if versions := report.Tasks[0].Versions; len(versions) != 1 || versions[0] != (ChangeReport{Name: "foo", Old: "1.2", New: "1.3"}) {
+		t.Errorf("versions=%+v", versions)
+	}
+	if !strings.Contains(FormatChanges([]TaskOutcome{{Name: "task", Result: result}}), "task: version foo 1.2 -> 1.3\n") {
+		t.Error("version missing from changes")
+	}
+}
+
+func TestRunUpdateScript_BackgroundProcess(t *testing.T) {
+	scriptWaitDelay = 100 * time.Millisecond
+	defer func() {
+		scriptWaitDelay = 5 * time.Second
+	}()
+	root := t.TempDir()
+	script := UpdateScript{
+		Executable: "sh",
+		Args:       []string{"-c", `sleep 2 & echo '::freshen-result::{"notes": ["started a daemon"]}'`},
+	}
+	start := time.Now()
+	result, err := RunUpdateScript(ScriptBuild{Output: "/bin"}, &script, root, &ScriptEnv{}, NewSnapshot(root), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waited %s for the background process", elapsed)
+	}
+	if !slices.Equal(result.notes, []string{"started a daemon"}) {
+		t.Errorf("notes=%v", result.notes)
+	}
+}
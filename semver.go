@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a semantic version parsed from a tag name
+type Version struct {
+	Major, Minor, Patch int
+	Prerelease          string
+}
+
+// ParseVersion parses tags like v1.2.3, 1.2 and 1.2.3-rc.1. Build metadata is ignored.
+func ParseVersion(tag string) (Version, bool) {
+	s := strings.TrimPrefix(tag, "v")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	var out Version
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		out.Prerelease = s[i+1:]
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) == 0 || len(parts) > 3 {
+		return Version{}, false
+	}
+	nums := []*int{&out.Major, &out.Minor, &out.Patch}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return Version{}, false
+		}
+		*nums[i] = n
+	}
+	return out, true
+}
+
+// Compare returns -1, 0 or 1. A prerelease is lower than the release with the same numbers.
+func (v Version) Compare(other Version) int {
+	for _, pair := range [][2]int{{v.Major, other.Major}, {v.Minor, other.Minor}, {v.Patch, other.Patch}} {
+		if pair[0] < pair[1] {
+			return -1
+		}
+		if pair[0] > pair[1] {
+			return 1
+		}
+	}
+	switch {
+	case v.Prerelease == other.Prerelease:
+		return 0
+	case v.Prerelease == "":
+		return 1
+	case other.Prerelease == "":
+		return -1
+	case v.Prerelease < other.Prerelease:
+		return -1
+	default:
+		return 1
+	}
+}
+
+func (v Version) String() string {
+	out := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Prerelease != "" {
+		out += "-" + v.Prerelease
+	}
+	return out
+}
+
+type versionComparator struct {
+	op string
+	v  Version
+}
+
+func (c versionComparator) matches(v Version) bool {
+	cmp := v.Compare(c.v)
+	switch c.op {
+	case ">=":
+		return cmp >= 0
+	case ">":
+		return cmp > 0
+	case "<=":
+		return cmp <= 0
+	case "<":
+		return cmp < 0
+	default:
+		return cmp == 0
+	}
+}
+
+// VersionRange is a set of alternatives separated by ||. Each alternative is a list of comparators that must all
+// match. Supported comparators: ^1.2.3, ~1.2.3, 1.2.x, 1.x, *, =1.2.3, >=1.2.3, >1.2.3, <=1.2.3 and <1.2.3.
+type VersionRange struct {
+	alternatives [][]versionComparator
+}
+
+func ParseVersionRange(s string) (VersionRange, error) {
+	var out VersionRange
+	for _, alternative := range strings.Split(s, "||") {
+		var comparators []versionComparator
+		fields := strings.Fields(alternative)
+		if len(fields) == 0 {
+			return VersionRange{}, fmt.Errorf("empty version range in %q", s)
+		}
+		for _, field := range fields {
+			parsed, err := parseComparator(field)
+			if err != nil {
+				return VersionRange{}, err
+			}
+			comparators = append(comparators, parsed...)
+		}
+		out.alternatives = append(out.alternatives, comparators)
+	}
+	return out, nil
+}
+
+// Matches reports whether v is in the range. Prereleases never match.
+func (r VersionRange) Matches(v Version) bool {
+	if v.Prerelease != "" {
+		return false
+	}
+	for _, alternative := range r.alternatives {
+		matched := true
+		for _, comparator := range alternative {
+			if !comparator.matches(v) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func parseComparator(s string) ([]versionComparator, error) {
+	if s == "*" || s == "x" {
+		return nil, nil
+	}
+	for _, op := range []string{">=", "<=", ">", "<", "="} {
+		if strings.HasPrefix(s, op) {
+			v, _, err := parsePartialVersion(s[len(op):])
+			if err != nil {
+				return nil, err
+			}
+			return []versionComparator{{op: op, v: v}}, nil
+		}
+	}
+	switch {
+	case strings.HasPrefix(s, "^"):
+		v, parts, err := parsePartialVersion(s[1:])
+		if err != nil {
+			return nil, err
+		}
+		upper := Version{Major: v.Major + 1}
+		if v.Major == 0 && parts > 1 {
+			upper = Version{Minor: v.Minor + 1}
+			if v.Minor == 0 && parts > 2 {
+				upper = Version{Patch: v.Patch + 1}
+			}
+		}
+		return []versionComparator{{op: ">=", v: v}, {op: "<", v: upper}}, nil
+	case strings.HasPrefix(s, "~"):
+		v, parts, err := parsePartialVersion(s[1:])
+		if err != nil {
+			return nil, err
+		}
+		upper := Version{Major: v.Major + 1}
+		if parts > 1 {
+			upper = Version{Major: v.Major, Minor: v.Minor + 1}
+		}
+		return []versionComparator{{op: ">=", v: v}, {op: "<", v: upper}}, nil
+	}
+	v, parts, err := parsePartialVersion(s)
+	if err != nil {
+		return nil, err
+	}
+	switch parts {
+	case 1:
+		return []versionComparator{{op: ">=", v: v}, {op: "<", v: Version{Major: v.Major + 1}}}, nil
+	case 2:
+		return []versionComparator{{op: ">=", v: v}, {op: "<", v: Version{Major: v.Major, Minor: v.Minor + 1}}}, nil
+	default:
+		return []versionComparator{{op: "=", v: v}}, nil
+	}
+}
+
+// parsePartialVersion parses a version where trailing parts can be missing or wildcards. Returns the number of
+// parts that were given.
+func parsePartialVersion(s string) (Version, int, error) {
+	trimmed := strings.TrimPrefix(s, "v")
+	var given []string
+	for _, part := range strings.SplitN(strings.SplitN(trimmed, "-", 2)[0], ".", 3) {
+		if part == "x" || part == "X" || part == "*" {
+			break
+		}
+		given = append(given, part)
+	}
+	if len(given) == 0 {
+		return Version{}, 0, fmt.Errorf("bad version %q", s)
+	}
+	versionStr := strings.Join(given, ".")
+	if len(given) == 3 {
+		versionStr = trimmed
+	}
+	v, ok := ParseVersion(versionStr)
+	if !ok {
+		return Version{}, 0, fmt.Errorf("bad version %q", s)
+	}
+	return v, len(given), nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestVersionRange_Matches(t *testing.T) {
+	cases := []struct {
+		versionRange string
+		tag          string
+		want         bool
+	}{
+		{"^2", "v2.9.1", true},
+		{"^2", "v3.0.0", false},
+		{"^2.1", "2.0.9", false},
+		{"^0.3", "0.3.7", true},
+		{"^0.3", "0.4.0", false},
+		{"~1.4", "1.4.9", true},
+		{"~1.4", "1.5.0", false},
+		{">=1.2 <2", "1.9.0", true},
+		{">=1.2 <2", "2.0.0", false},
+		{"1.2.x", "1.2.5", true},
+		{"1.x || 3.x", "3.1.0", true},
+		{"1.x || 3.x", "2.1.0", false},
+		{"^2", "v2.1.0-rc.1", false},
+		{"*", "v0.0.1", true},
+	}
+	for _, c := range cases {
+		versionRange, err := ParseVersionRange(c.versionRange)
+		if err != nil {
+			t.Fatalf("range=%s: %s", c.versionRange, err)
+		}
+		v, ok := ParseVersion(c.tag)
+		if !ok {
+			t.Fatalf("tag=%s did not parse", c.tag)
+		}
+		if got := versionRange.Matches(v); got != c.want {
+			t.Errorf("range=%s tag=%s got=%t want=%t", c.versionRange, c.tag, got, c.want)
+		}
+	}
+}
+
+func TestVersion_Compare(t *testing.T) {
+	a, _ := ParseVersion("v1.2.3-rc.1")
+	b, _ := ParseVersion("1.2.3")
+	if a.Compare(b) != -1 || b.Compare(a) != 1 {
+		t.Fatal("prerelease should sort before release")
+	}
+	if _, ok := ParseVersion("latest"); ok {
+		t.Fatal("non-version tag parsed")
+	}
+}
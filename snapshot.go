@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+// Snapshot records the original content of files in the flake root before a task changes them, so that a failed
+// task can be undone. A nil Snapshot records nothing.
+type Snapshot struct {
+	root string
+	// original content by path relative to root. nil if the file did not exist.
+	files map[string][]byte
+	// original permissions by path, used to recreate deleted files
+	modes map[string]os.FileMode
+}
+
+func NewSnapshot(root string) *Snapshot {
+	return &Snapshot{
+		root:  root,
+		files: make(map[string][]byte),
+		modes: make(map[string]os.FileMode),
+	}
+}
+
+// Save records the current content of relPath. Only the first call for a path has an effect.
+func (s *Snapshot) Save(relPath string) error {
+	if s == nil {
+		return nil
+	}
+	relPath = path.Clean(relPath)
+	if _, ok := s.files[relPath]; ok {
+		return nil
+	}
+	fullPath := path.Join(s.root, relPath)
+	info, err := os.Stat(fullPath)
+	if os.IsNotExist(err) {
+		s.files[relPath] = nil
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("os.Stat %s: %w", relPath, err)
+	}
+	buf, err := os.ReadFile(fullPath)
+	if err != nil {
+		return fmt.Errorf("os.ReadFile %s: %w", relPath, err)
+	}
+	s.modes[relPath] = info.Mode().Perm()
+	if buf == nil {
+		buf = []byte{}
+	}
+	s.files[relPath] = buf
+	return nil
+}
+
+// SavePaths calls Save for each path
+func (s *Snapshot) SavePaths(relPaths []string) error {
+	for _, relPath := range relPaths {
+		if err := s.Save(relPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Adopt records the content that other saved, for each path that s has not saved yet. Used to keep the changes of
+// a nested run, such as one input of the fallback, undoable as part of the whole task.
+func (s *Snapshot) Adopt(other *Snapshot) {
+	if s == nil || other == nil {
+		return
+	}
+	for relPath, buf := range other.files {
+		if _, ok := s.files[relPath]; ok {
+			continue
+		}
+		s.files[relPath] = buf
+		if mode, ok := other.modes[relPath]; ok {
+			s.modes[relPath] = mode
+		}
+	}
+}
+
+// Restore writes back the recorded content and removes files that did not exist
+func (s *Snapshot) Restore() error {
+	if s == nil {
+		return nil
+	}
+	for relPath, buf := range s.files {
+		fullPath := path.Join(s.root, relPath)
+		if buf == nil {
+			if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("os.Remove %s: %w", relPath, err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(path.Dir(fullPath), 0777); err != nil {
+			return fmt.Errorf("os.MkdirAll: %w", err)
+		}
+		if err := os.WriteFile(fullPath, buf, s.modes[relPath]); err != nil {
+			return fmt.Errorf("os.WriteFile %s: %w", relPath, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"github.com/squalus/freshen/flake"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSnapshot_RestoreModified(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, "modified.txt", "original")
+	snapshot := NewSnapshot(root)
+	if err := snapshot.Save("modified.txt"); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, root, "modified.txt", "changed")
+	// only the first save of a path counts
+	if err := snapshot.Save("./modified.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := snapshot.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := os.ReadFile(path.Join(root, "modified.txt")); err != nil || string(buf) != "original" {
+		t.Errorf("modified.txt=%q err=%v", buf, err)
+	}
+
+	var nilSnapshot *Snapshot
+	if err := nilSnapshot.Save("modified.txt"); err != nil {
+		t.Error(err)
+	}
+	if err := nilSnapshot.Restore(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSnapshot_RestoreAddedAndDeleted(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, "dir/deleted.sh", "#!/bin/sh")
+	if err := os.Chmod(path.Join(root, "dir/deleted.sh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := NewSnapshot(root)
+	if err := snapshot.SavePaths([]string{"dir/deleted.sh", "added.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(path.Join(root, "dir")); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, root, "added.txt", "new")
+
+	if err := snapshot.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path.Join(root, "dir/deleted.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("mode=%s", info.Mode())
+	}
+	if _, err := os.Stat(path.Join(root, "added.txt")); !os.IsNotExist(err) {
+		t.Errorf("added.txt not removed: %v", err)
+	}
+}
+
+func TestRunTask_FailedRestores(t *testing.T) {
+	// the update script builds, the main derivation does not
+	fakeNix(t, `case "$1 $2" in
+"flake lock") sed -i "s/\"$4-old\"/\"$4-new\"/" flake.lock ;;
+"build --json") echo '[{"outputs": {"out": "/nix/store/../../bin"}}]' ;;
+"build -L") echo "error: builder for '/nix/store/abc-default.drv' failed with exit code 1" >&2; exit 1 ;;
+esac`)
+	root := t.TempDir()
+	writeTestFile(t, root, "flake.lock", fallbackTestLock)
+	writeTestFile(t, root, "version.txt", "1.2")
+	config := &UpdateTask{
+		Name:         "task",
+		Inputs:       []string{"a"},
+		MainAttrPath: "default",
+		UpdateScripts: []UpdateScript{{AttrPath: "script", Executable: "sh", Args: []string{"-c", `echo 1.3 > version.txt
+echo new > added.txt`}}},
+	}
+	spec := &UpdateSpec{Flake: flake.Flake{Path: root}, Config: &FreshenConfig{}}
+	if _, err := spec.runTask(config, NewUpdateResult(), false); err == nil {
+		t.Fatal("want error")
+	}
+	for relPath, want := range map[string]string{"flake.lock": fallbackTestLock, "version.txt": "1.2"} {
+		if buf, err := os.ReadFile(path.Join(root, relPath)); err != nil || string(buf) != want {
+			t.Errorf("%s=%q err=%v want=%q", relPath, buf, err, want)
+		}
+	}
+	if _, err := os.Stat(path.Join(root, "added.txt")); !os.IsNotExist(err) {
+		t.Errorf("file added by the update script was not removed: %v", err)
+	}
+}
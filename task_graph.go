@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// TaskGraph is the dependency graph formed by the RequiredUpdateTasks of each update task
+type TaskGraph struct {
+	nameToConfig map[string]*UpdateTask
+	// names in config file order
+	names []string
+}
+
+// NewTaskGraph validates the task references in config and rejects dependency cycles
+func NewTaskGraph(config *FreshenConfig) (*TaskGraph, error) {
+	var out TaskGraph
+	out.nameToConfig = make(map[string]*UpdateTask, len(config.UpdateTasks))
+	for i, curConfig := range config.UpdateTasks {
+		if _, ok := out.nameToConfig[curConfig.Name]; ok {
+			return nil, fmt.Errorf("duplicate update task name=%s", curConfig.Name)
+		}
+		out.nameToConfig[curConfig.Name] = &config.UpdateTasks[i]
+		out.names = append(out.names, curConfig.Name)
+	}
+	for _, name := range out.names {
+		for _, required := range out.nameToConfig[name].RequiredUpdateTasks {
+			if _, ok := out.nameToConfig[required]; !ok {
+				return nil, fmt.Errorf("name=%s requires unknown update task=%s", name, required)
+			}
+		}
+	}
+	if _, err := out.Plan(out.names...); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Task returns the config of the named update task
+func (g *TaskGraph) Task(name string) (*UpdateTask, error) {
+	config, ok := g.nameToConfig[name]
+	if !ok {
+		return nil, fmt.Errorf("no update config with name=%s validNames=%s", name, strings.Join(g.names, ","))
+	}
+	return config, nil
+}
+
+// Select returns the names of the tasks matched by any of the name glob patterns or tags, in config file order.
+// Every pattern and tag must match at least one task.
+func (g *TaskGraph) Select(patterns, tags []string, all bool) ([]string, error) {
+	if all {
+		return append([]string{}, g.names...), nil
+	}
+	selected := make(map[string]struct{})
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad name pattern=%s %w", pattern, err)
+		}
+		matched := false
+		for _, name := range g.names {
+			if ok, _ := path.Match(pattern, name); ok {
+				selected[name] = struct{}{}
+				matched = true
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("no update config with name=%s validNames=%s", pattern, strings.Join(g.names, ","))
+		}
+	}
+	for _, tag := range tags {
+		matched := false
+		for _, name := range g.names {
+			for _, taskTag := range g.nameToConfig[name].Tags {
+				if taskTag == tag {
+					selected[name] = struct{}{}
+					matched = true
+				}
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("no update config with tag=%s", tag)
+		}
+	}
+	var out []string
+	for _, name := range g.names {
+		if _, ok := selected[name]; ok {
+			out = append(out, name)
+		}
+	}
+	return out, nil
+}
+
+// Plan returns the named tasks and everything they require, each exactly once, in an order where every task
+// comes after the tasks it requires
+func (g *TaskGraph) Plan(names ...string) ([]string, error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(g.nameToConfig))
+	var stack []string
+	var out []string
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			start := 0
+			for i, stackName := range stack {
+				if stackName == name {
+					start = i
+					break
+				}
+			}
+			cycle := append(append([]string{}, stack[start:]...), name)
+			return fmt.Errorf("update task cycle: %s", strings.Join(cycle, " -> "))
+		}
+		config, err := g.Task(name)
+		if err != nil {
+			return err
+		}
+		state[name] = visiting
+		stack = append(stack, name)
+		for _, required := range config.RequiredUpdateTasks {
+			if err := visit(required); err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = visited
+		out = append(out, name)
+		return nil
+	}
+
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// FormatPlan renders a plan as numbered lines, one per task
+func (g *TaskGraph) FormatPlan(plan []string) string {
+	var sb strings.Builder
+	for i, name := range plan {
+		fmt.Fprintf(&sb, "%d. %s", i+1, name)
+		if required := g.nameToConfig[name].RequiredUpdateTasks; len(required) > 0 {
+			fmt.Fprintf(&sb, " (requires %s)", strings.Join(required, ", "))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
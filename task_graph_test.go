@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testTasks(edges map[string][]string, names ...string) *FreshenConfig {
+	var config FreshenConfig
+	for _, name := range names {
+		config.UpdateTasks = append(config.UpdateTasks, UpdateTask{Name: name, RequiredUpdateTasks: edges[name]})
+	}
+	return &config
+}
+
+func TestTaskGraph_PlanDiamond(t *testing.T) {
+	config := testTasks(map[string][]string{
+		"a": {"b", "c"},
+		"b": {"d"},
+		"c": {"d"},
+	}, "a", "b", "c", "d")
+	graph, err := NewTaskGraph(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := graph.Plan("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(plan, []string{"d", "b", "c", "a"}) {
+		t.Fatalf("unexpected plan: %v", plan)
+	}
+}
+
+func TestTaskGraph_Cycle(t *testing.T) {
+	config := testTasks(map[string][]string{
+		"a": {"b"},
+		"b": {"c"},
+		"c": {"a"},
+	}, "a", "b", "c")
+	_, err := NewTaskGraph(config)
+	if err == nil {
+		t.Fatal("expected cycle error")
+	}
+	if !strings.Contains(err.Error(), "a -> b -> c -> a") {
+		t.Fatalf("cycle path missing: %s", err)
+	}
+}
+
+func TestTaskGraph_UnknownRequired(t *testing.T) {
+	config := testTasks(map[string][]string{"a": {"missing"}}, "a")
+	if _, err := NewTaskGraph(config); err == nil {
+		t.Fatal("expected unknown task error")
+	}
+}
+
+func TestTaskGraph_Select(t *testing.T) {
+	config := testTasks(nil, "go-foo", "go-bar", "rust-baz")
+	config.UpdateTasks[2].Tags = []string{"rust"}
+	graph, err := NewTaskGraph(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selected, err := graph.Select([]string{"go-*"}, []string{"rust"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(selected, []string{"go-foo", "go-bar", "rust-baz"}) {
+		t.Fatalf("unexpected selection: %v", selected)
+	}
+	if _, err := graph.Select([]string{"python-*"}, nil, false); err == nil {
+		t.Fatal("expected error for unmatched pattern")
+	}
+}
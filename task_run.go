@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type TaskStatus string
+
+const (
+	TaskStatusUpdated   TaskStatus = "updated"
+	TaskStatusUnchanged TaskStatus = "unchanged"
+	TaskStatusFailed    TaskStatus = "failed"
+	TaskStatusSkipped   TaskStatus = "skipped"
+)
+
+// TaskOutcome is the result of one update task within a run
+type TaskOutcome struct {
+	Name   string
+	Status TaskStatus
+	// Result includes the changes made by the tasks this task requires
+	Result   UpdateResult
+	Err      error
+	Duration time.Duration
+}
+
+// RunUpdateNames runs the named update tasks and the tasks they require. Each task runs once. A failed task does
+// not stop the run, but the tasks that require it are skipped. Outcomes are returned in plan order.
+func (a *UpdateSpec) RunUpdateNames(names []string, check bool) ([]TaskOutcome, error) {
+	plan, err := a.Graph.Plan(names...)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("plan=%s", strings.Join(plan, ","))
+	outcomes := make(map[string]TaskOutcome, len(plan))
+	out := make([]TaskOutcome, 0, len(plan))
+	for _, taskName := range plan {
+		config, err := a.Graph.Task(taskName)
+		if err != nil {
+			return nil, err
+		}
+		outcome := a.runPlannedTask(config, outcomes, check)
+		out = append(out, outcome)
+		outcomes[taskName] = outcome
+	}
+	return out, nil
+}
+
+func (a *UpdateSpec) runPlannedTask(config *UpdateTask, outcomes map[string]TaskOutcome, check bool) TaskOutcome {
+	out := TaskOutcome{Name: config.Name}
+	requiredResult := NewUpdateResult()
+	for _, required := range config.RequiredUpdateTasks {
+		requiredOutcome := outcomes[required]
+		if requiredOutcome.Status == TaskStatusFailed || requiredOutcome.Status == TaskStatusSkipped {
+			log.Printf("name=%s skipped: required task=%s %s", config.Name, required, requiredOutcome.Status)
+			out.Status = TaskStatusSkipped
+			out.Err = fmt.Errorf("linkedUpdate=%s %s: %w", required, requiredOutcome.Status, requiredOutcome.Err)
+			return out
+		}
+		requiredResult.union(requiredOutcome.Result)
+	}
+	taskSpec := *a
+	taskSpec.recorder = &taskRecorder{}
+	start := time.Now()
+	result, err := taskSpec.runTask(config, requiredResult, check)
+	out.Duration = time.Since(start)
+	switch {
+	case err != nil:
+		log.Printf("name=%s failed: %s", config.Name, err)
+		out.Status = TaskStatusFailed
+		out.Err = err
+		out.Result = NewUpdateResult()
+		var disallowed *DisallowedPathsError
+		if errors.As(err, &disallowed) {
+			for _, rejectedPath := range disallowed.Paths {
+				out.Result.rejectPath(rejectedPath)
+			}
+		}
+	case result.empty():
+		out.Status = TaskStatusUnchanged
+		out.Result = NewUpdateResult()
+		out.Result.union(result)
+	default:
+		out.Status = TaskStatusUpdated
+		out.Result = result
+	}
+	out.Result.steps = taskSpec.recorder.steps
+	return out
+}
+
+// FormatSummary renders the outcomes as a table with one row per task
+func FormatSummary(outcomes []TaskOutcome) string {
+	var sb strings.Builder
+	tw := tabwriter.NewWriter(&sb, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "TASK\tSTATUS\tDURATION\tFILES\tHELD BACK\tERROR")
+	for _, outcome := range outcomes {
+		files := "-"
+		if !outcome.Result.empty() {
+			files = strings.Join(outcome.Result.getPathsChanged(), ",")
+		}
+		heldBack := "-"
+		if names := heldBackNames(outcome.Result); len(names) > 0 {
+			heldBack = strings.Join(names, ",")
+		}
+		errMsg := "-"
+		if outcome.Err != nil {
+			errMsg = outcome.Err.Error()
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", outcome.Name, outcome.Status, outcome.Duration.Round(time.Second), files, heldBack, errMsg)
+	}
+	_ = tw.Flush()
+	for _, outcome := range outcomes {
+		for _, input := range outcome.Result.getHeldBack() {
+			fmt.Fprintf(&sb, "%s: input=%s held back: %s\n", outcome.Name, input, outcome.Result.heldBack[input])
+		}
+		for _, input := range outcome.Result.getDeferred() {
+			fmt.Fprintf(&sb, "%s: input=%s deferred: %s\n", outcome.Name, input, outcome.Result.deferred[input])
+		}
+	}
+	for _, outcome := range outcomes {
+		for _, rejectedPath := range sortedKeys(outcome.Result.pathsRejected) {
+			fmt.Fprintf(&sb, "%s: file=%s rejected: outside allowed_paths\n", outcome.Name, rejectedPath)
+		}
+	}
+	for _, outcome := range outcomes {
+		for _, step := range outcome.Result.steps {
+			if step.Kind != StepKindTest {
+				continue
+			}
+			if step.Status == StepStatusFailed {
+				fmt.Fprintf(&sb, "%s: test %s failed: %s\n", outcome.Name, step.Name, step.Detail)
+			} else {
+				fmt.Fprintf(&sb, "%s: test %s passed\n", outcome.Name, step.Name)
+			}
+		}
+	}
+	return sb.String()
+}
+
+// FormatChanges lists the input, hash and file changes of the outcomes. A change that a task inherited from a
+// task it requires is only listed for the required task.
+func FormatChanges(outcomes []TaskOutcome) string {
+	var sb strings.Builder
+	listed := make(map[string]struct{})
+	line := func(key, format string, args ...any) {
+		if _, ok := listed[key]; ok {
+			return
+		}
+		listed[key] = struct{}{}
+		fmt.Fprintf(&sb, format, args...)
+	}
+	for _, outcome := range outcomes {
+		result := outcome.Result
+		for _, input := range sortedKeys(result.inputsChanged) {
+			change := result.inputsChanged[input]
+			line("input:"+input, "%s: input %s %s -> %s\n", outcome.Name, input, change.old, change.new)
+		}
+		for _, hashPath := range sortedKeys(result.hashesChanged) {
+			change := result.hashesChanged[hashPath]
+			line("hash:"+hashPath, "%s: hash %s %s -> %s\n", outcome.Name, hashPath, change.old, change.new)
+		}
+		for _, versionName := range sortedKeys(result.versionsChanged) {
+			change := result.versionsChanged[versionName]
+			line("version:"+versionName, "%s: version %s %s -> %s\n", outcome.Name, versionName, change.old, change.new)
+		}
+		for _, changedPath := range result.getPathsChanged() {
+			switch {
+			case result.isAdded(changedPath):
+				line("file:"+changedPath, "%s: file %s (added)\n", outcome.Name, changedPath)
+			case result.isDeleted(changedPath):
+				line("file:"+changedPath, "%s: file %s (deleted)\n", outcome.Name, changedPath)
+			default:
+				line("file:"+changedPath, "%s: file %s\n", outcome.Name, changedPath)
+			}
+		}
+	}
+	return sb.String()
+}
+
+// heldBackNames lists the held back and deferred inputs of a result
+func heldBackNames(result UpdateResult) []string {
+	out := result.getHeldBack()
+	for _, input := range result.getDeferred() {
+		out = append(out, input+" (deferred)")
+	}
+	return out
+}
+
+// countFailed returns how many outcomes did not complete
+func countFailed(outcomes []TaskOutcome) int {
+	var out int
+	for _, outcome := range outcomes {
+		if outcome.Status == TaskStatusFailed || outcome.Status == TaskStatusSkipped {
+			out++
+		}
+	}
+	return out
+}
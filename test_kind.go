@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"github.com/squalus/freshen/flake"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type TestKind string
+
+const (
+	TestKindBuild      TestKind = "build"
+	TestKindRun        TestKind = "run"
+	TestKindFlakeCheck TestKind = "flake_check"
+	TestKindDevelop    TestKind = "develop"
+)
+
+// TestResult is the pass or fail result of one test
+type TestResult struct {
+	// Name is the kind of the test and what it ran, e.g. run:hello
+	Name   string
+	Passed bool
+	// Reason the test failed
+	Reason string
+}
+
+func (t TestResult) String() string {
+	if t.Passed {
+		return t.Name + " passed"
+	}
+	return t.Name + " failed: " + t.Reason
+}
+
+// TestsFailedError is returned when at least one test of a task failed. Results holds every test that ran.
+type TestsFailedError struct {
+	Results []TestResult
+}
+
+func (e *TestsFailedError) Error() string {
+	var failed []string
+	for _, result := range e.Results {
+		if !result.Passed {
+			failed = append(failed, result.Name+": "+result.Reason)
+		}
+	}
+	return "tests failed: " + strings.Join(failed, "; ")
+}
+
+func (t *TestConfig) kind() TestKind {
+	if t.Kind == "" {
+		return TestKindBuild
+	}
+	return TestKind(t.Kind)
+}
+
+// runTests runs every test of a task. A failed test does not stop the others, so that each one has a result.
+func (a *UpdateSpec) runTests(config *UpdateTask, snapshot *Snapshot) (UpdateResult, error) {
+	out := NewUpdateResult()
+	var results []TestResult
+	var failed bool
+	for i := range config.Tests {
+		start := time.Now()
+		testResults, fixupResult := a.runTest(config, &config.Tests[i], snapshot)
+		out.union(fixupResult)
+		for _, result := range testResults {
+			log.Printf("name=%s test %s", config.Name, result)
+			if result.Passed {
+				a.recorder.add(StepKindTest, result.Name, start, StepStatusPassed, "")
+			} else {
+				a.recorder.add(StepKindTest, result.Name, start, StepStatusFailed, result.Reason)
+			}
+			failed = failed || !result.Passed
+		}
+		results = append(results, testResults...)
+	}
+	if failed {
+		return out, &TestsFailedError{Results: results}
+	}
+	return out, nil
+}
+
+// runTest runs a single test. Builds made by the test can repair hash mismatches, which are returned as changes.
+func (a *UpdateSpec) runTest(config *UpdateTask, test *TestConfig, snapshot *Snapshot) ([]TestResult, UpdateResult) {
+	sandbox := !test.DisableSandbox
+	switch test.kind() {
+	case TestKindBuild:
+		fixupResult, err := a.buildWithHashFixup(config, test.AttrPath, sandbox, test.Retry, snapshot)
+		return []TestResult{testResult("build:"+test.AttrPath, err)}, fixupResult
+	case TestKindRun:
+		if test.Executable == "" {
+			// nix run resolves apps, which nix build cannot build, so there is no build to repair first
+			name := "run:" + test.AttrPath
+			output, exitCode, err := a.Flake.Run(test.AttrPath, test.Args)
+			if err == nil {
+				err = test.checkCommand(output, exitCode)
+			}
+			return []TestResult{testResult(name, err)}, NewUpdateResult()
+		}
+		name := "run:" + test.AttrPath + "/" + test.Executable
+		fixupResult, err := a.buildWithHashFixup(config, test.AttrPath, sandbox, test.Retry, snapshot)
+		if err != nil {
+			return []TestResult{testResult(name, err)}, fixupResult
+		}
+		var output string
+		var exitCode int
+		var storePath string
+		if storePath, err = a.Flake.Build(test.AttrPath); err == nil {
+			output, exitCode, err = a.Flake.RunExecutable(path.Join(storePath, test.Executable), test.Args)
+		}
+		if err == nil {
+			err = test.checkCommand(output, exitCode)
+		}
+		return []TestResult{testResult(name, err)}, fixupResult
+	case TestKindFlakeCheck:
+		return a.runFlakeCheck(config, test, snapshot)
+	case TestKindDevelop:
+		name := "develop:" + test.AttrPath
+		if test.AttrPath == "" {
+			name = "develop:default"
+		}
+		output, exitCode, err := a.Flake.Develop(test.AttrPath, test.Command)
+		if err == nil {
+			err = test.checkCommand(output, exitCode)
+		}
+		return []TestResult{testResult(name, err)}, NewUpdateResult()
+	default:
+		err := fmt.Errorf("unknown test kind=%s", test.Kind)
+		return []TestResult{testResult(test.Kind+":"+test.AttrPath, err)}, NewUpdateResult()
+	}
+}
+
+// runFlakeCheck builds the named checks for the current system, or runs nix flake check if none are named
+func (a *UpdateSpec) runFlakeCheck(config *UpdateTask, test *TestConfig, snapshot *Snapshot) ([]TestResult, UpdateResult) {
+	if len(test.Checks) == 0 {
+		_, stderr, err := a.Flake.Check(!test.DisableSandbox)
+		if err != nil {
+			err = fmt.Errorf("%s failure: %w", ClassifyFailure(stderr), err)
+		}
+		return []TestResult{testResult("flake_check", err)}, NewUpdateResult()
+	}
+	system, err := flake.CurrentSystem()
+	if err != nil {
+		return []TestResult{testResult("flake_check", err)}, NewUpdateResult()
+	}
+	out := NewUpdateResult()
+	var results []TestResult
+	for _, check := range test.Checks {
+		attrPath := fmt.Sprintf("checks.%s.%s", system, check)
+		fixupResult, err := a.buildWithHashFixup(config, attrPath, !test.DisableSandbox, test.Retry, snapshot)
+		out.union(fixupResult)
+		results = append(results, testResult("flake_check:"+check, err))
+	}
+	return results, out
+}
+
+// checkCommand compares the output and exit code of a run or develop test with the expected ones
+func (t *TestConfig) checkCommand(output string, exitCode int) error {
+	if exitCode != t.ExitCode {
+		return fmt.Errorf("exit code %d, want %d", exitCode, t.ExitCode)
+	}
+	if t.OutputRegex == "" {
+		return nil
+	}
+	re, err := regexp.Compile(t.OutputRegex)
+	if err != nil {
+		return fmt.Errorf("output_regex: %w", err)
+	}
+	if !re.MatchString(output) {
+		return fmt.Errorf("output does not match %q", t.OutputRegex)
+	}
+	return nil
+}
+
+func testResult(name string, err error) TestResult {
+	if err != nil {
+		return TestResult{Name: name, Reason: err.Error()}
+	}
+	return TestResult{Name: name, Passed: true}
+}
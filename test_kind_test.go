@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/squalus/freshen/flake"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestTestConfig_checkCommand(t *testing.T) {
+	cases := []struct {
+		test     TestConfig
+		output   string
+		exitCode int
+		pass     bool
+	}{
+		{TestConfig{}, "", 0, true},
+		{TestConfig{}, "", 1, false},
+		{TestConfig{ExitCode: 2}, "", 2, true},
+		{TestConfig{OutputRegex: `^hello \d+\.\d+`}, "hello 2.12\n", 0, true},
+		{TestConfig{OutputRegex: `^hello \d+\.\d+`}, "goodbye\n", 0, false},
+		{TestConfig{OutputRegex: `hello`}, "hello", 1, false},
+		{TestConfig{OutputRegex: `(`}, "hello", 0, false},
+	}
+	for _, c := range cases {
+		err := c.test.checkCommand(c.output, c.exitCode)
+		if (err == nil) != c.pass {
+			t.Errorf("test=%+v output=%q exitCode=%d err=%v", c.test, c.output, c.exitCode, err)
+		}
+	}
+}
+
+func TestTestsFailedError(t *testing.T) {
+	err := &TestsFailedError{Results: []TestResult{
+		testResult("build:hello", nil),
+		{Name: "run:hello", Reason: "exit code 1, want 0"},
+	}}
+	want := "tests failed: run:hello: exit code 1, want 0"
+	if err.Error() != want {
+		t.Fatalf("got=%q want=%q", err.Error(), want)
+	}
+}
+
+// fakeNix puts a nix script on PATH that runs body with the nix arguments
+func fakeNix(t *testing.T, body string) {
+	t.Helper()
+	binDir := t.TempDir()
+	writeTestFile(t, binDir, "nix", "#!/bin/sh\n"+body)
+	if err := os.Chmod(path.Join(binDir, "nix"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+}
+
+func TestRunTest_RunApp(t *testing.T) {
+	// hello is only an app: nix build fails, nix run works
+	fakeNix(t, `case "$1" in
+run) echo "hello 1.0" ;;
+*) echo "error: flake does not provide attribute 'packages.x86_64-linux.hello'" >&2; exit 1 ;;
+esac`)
+	spec := &UpdateSpec{Flake: flake.Flake{Path: t.TempDir()}}
+	test := TestConfig{Kind: string(TestKindRun), AttrPath: "hello", OutputRegex: `^hello \d`}
+	results, _ := spec.runTest(&UpdateTask{Name: "task"}, &test, nil)
+	if len(results) != 1 || !results[0].Passed || results[0].Name != "run:hello" {
+		t.Errorf("results=%+v", results)
+	}
+}
@@ -1,26 +1,207 @@
 package main
 
+import (
+	"slices"
+	"sort"
+)
+
 type UpdateResult struct {
-	// changed paths, relative to repo root
+	// changed paths, relative to repo root. Includes added and deleted paths.
 	pathsChanged map[string]struct{}
+	// changed paths that did not exist before
+	pathsAdded map[string]struct{}
+	// changed paths that no longer exist
+	pathsDeleted map[string]struct{}
+	// paths changed by update scripts outside their allowed_paths, which were dropped
+	pathsRejected map[string]struct{}
+	// inputs whose update was not kept, with the reason
+	heldBack map[string]string
+	// inputs whose update was postponed to a later run, with the reason
+	deferred map[string]string
+	// revisions of updated inputs, by input name
+	inputsChanged map[string]valueChange
+	// derived and fixed hashes, by path of the file they are stored in
+	hashesChanged map[string]valueChange
+	// upstream changelogs of changed inputs, by input name
+	changelogs map[string]Changelog
+	// versions reported by update scripts, by name
+	versionsChanged map[string]valueChange
+	// notes and commit message paragraphs reported by update scripts, in order
+	notes            []string
+	messageFragments []string
+	// steps run by the task itself, in order. Not merged by union.
+	steps []StepReport
+}
+
+// valueChange is the old and new value of a revision or hash
+type valueChange struct {
+	old, new string
 }
 
 func NewUpdateResult() UpdateResult {
 	return UpdateResult{
-		pathsChanged: make(map[string]struct{}),
+		pathsChanged:    make(map[string]struct{}),
+		pathsAdded:      make(map[string]struct{}),
+		pathsDeleted:    make(map[string]struct{}),
+		pathsRejected:   make(map[string]struct{}),
+		heldBack:        make(map[string]string),
+		deferred:        make(map[string]string),
+		inputsChanged:   make(map[string]valueChange),
+		hashesChanged:   make(map[string]valueChange),
+		changelogs:      make(map[string]Changelog),
+		versionsChanged: make(map[string]valueChange),
 	}
 }
 
 func (u *UpdateResult) union(other UpdateResult) {
 	for pathChanged, _ := range other.pathsChanged {
-		u.addPath(pathChanged)
+		if _, ok := other.pathsAdded[pathChanged]; ok {
+			u.addNewPath(pathChanged)
+		} else if _, ok := other.pathsDeleted[pathChanged]; ok {
+			u.deletePath(pathChanged)
+		} else {
+			u.addPath(pathChanged)
+		}
+	}
+	for rejectedPath := range other.pathsRejected {
+		u.rejectPath(rejectedPath)
+	}
+	for input, reason := range other.heldBack {
+		u.holdBack(input, reason)
+	}
+	for input, reason := range other.deferred {
+		u.deferInput(input, reason)
+	}
+	for input, change := range other.inputsChanged {
+		u.changeInput(input, change.old, change.new)
+	}
+	for hashPath, change := range other.hashesChanged {
+		u.changeHash(hashPath, change.old, change.new)
+	}
+	for _, changelog := range other.changelogs {
+		u.addChangelog(changelog)
+	}
+	for name, change := range other.versionsChanged {
+		u.changeVersion(name, change.old, change.new)
+	}
+	for _, note := range other.notes {
+		u.addNote(note)
+	}
+	for _, fragment := range other.messageFragments {
+		u.addMessageFragment(fragment)
 	}
 }
 
+func (u *UpdateResult) changeInput(input, old, new string) {
+	if prev, ok := u.inputsChanged[input]; ok {
+		old = prev.old
+	}
+	u.inputsChanged[input] = valueChange{old: old, new: new}
+}
+
+func (u *UpdateResult) changeHash(hashPath, old, new string) {
+	if prev, ok := u.hashesChanged[hashPath]; ok {
+		old = prev.old
+	}
+	u.hashesChanged[hashPath] = valueChange{old: old, new: new}
+}
+
+func (u *UpdateResult) changeVersion(name, old, new string) {
+	if prev, ok := u.versionsChanged[name]; ok {
+		old = prev.old
+	}
+	u.versionsChanged[name] = valueChange{old: old, new: new}
+}
+
+func (u *UpdateResult) addNote(note string) {
+	if !slices.Contains(u.notes, note) {
+		u.notes = append(u.notes, note)
+	}
+}
+
+func (u *UpdateResult) addMessageFragment(fragment string) {
+	if !slices.Contains(u.messageFragments, fragment) {
+		u.messageFragments = append(u.messageFragments, fragment)
+	}
+}
+
+func (u *UpdateResult) addChangelog(changelog Changelog) {
+	u.changelogs[changelog.Input] = changelog
+}
+
+func (u *UpdateResult) deferInput(input, reason string) {
+	u.deferred[input] = reason
+}
+
+func (u *UpdateResult) holdBack(input, reason string) {
+	u.heldBack[input] = reason
+}
+
+func (u *UpdateResult) getHeldBack() []string {
+	return sortedKeys(u.heldBack)
+}
+
+func (u *UpdateResult) getDeferred() []string {
+	return sortedKeys(u.deferred)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
 func (u *UpdateResult) addPath(path string) {
 	u.pathsChanged[path] = struct{}{}
 }
 
+// addNewPath records a file that was created. A file that was deleted earlier and created again counts as modified.
+func (u *UpdateResult) addNewPath(path string) {
+	if _, ok := u.pathsDeleted[path]; ok {
+		delete(u.pathsDeleted, path)
+	} else {
+		u.pathsAdded[path] = struct{}{}
+	}
+	u.addPath(path)
+}
+
+// deletePath records a file that was removed. A file that was created earlier and removed again is not a change.
+func (u *UpdateResult) deletePath(path string) {
+	if _, ok := u.pathsAdded[path]; ok {
+		delete(u.pathsAdded, path)
+		delete(u.pathsChanged, path)
+		return
+	}
+	u.pathsDeleted[path] = struct{}{}
+	u.addPath(path)
+}
+
+// rejectPath records that an update script's change to path was rejected. Changes to path made by other steps are
+// kept.
+func (u *UpdateResult) rejectPath(path string) {
+	u.pathsRejected[path] = struct{}{}
+}
+
+// dropPath removes a change to path
+func (u *UpdateResult) dropPath(path string) {
+	delete(u.pathsChanged, path)
+	delete(u.pathsAdded, path)
+	delete(u.pathsDeleted, path)
+}
+
+func (u *UpdateResult) isAdded(path string) bool {
+	_, ok := u.pathsAdded[path]
+	return ok
+}
+
+func (u *UpdateResult) isDeleted(path string) bool {
+	_, ok := u.pathsDeleted[path]
+	return ok
+}
+
 func (u *UpdateResult) addPaths(paths []string) {
 	for _, pathChanged := range paths {
 		u.addPath(pathChanged)
@@ -32,6 +213,7 @@ func (u *UpdateResult) getPathsChanged() []string {
 	for k, _ := range u.pathsChanged {
 		out = append(out, k)
 	}
+	sort.Strings(out)
 	return out
 }
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/go-git/go-billy/v5/osfs"
 	"github.com/go-git/go-git/v5"
@@ -11,45 +12,197 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"strings"
+	"time"
 )
 
-func RunUpdateScript(scriptOutput string, config *UpdateScript, flakeRoot string) (UpdateResult, error) {
-	tmpDir, err := os.MkdirTemp("", "")
+type ScriptKind string
+
+// scriptWaitDelay is how long the output of a script is read after it exited. A background process the script
+// started could keep its stdout open forever.
+var scriptWaitDelay = 5 * time.Second
+
+const (
+	ScriptKindBuild   ScriptKind = "build"
+	ScriptKindDevelop ScriptKind = "develop"
+	ScriptKindRepo    ScriptKind = "repo"
+)
+
+// ScriptBuild is what was built for an update script before it runs
+type ScriptBuild struct {
+	// Output is the store path of AttrPath, for build scripts
+	Output string
+	// PathDirs are the bin directories of PathAttrs, for repo scripts
+	PathDirs []string
+}
+
+// name identifies the script in logs and reports
+func (s *UpdateScript) name() string {
+	switch ScriptKind(s.Kind) {
+	case ScriptKindDevelop:
+		return strings.Join(s.Command, " ")
+	case ScriptKindRepo:
+		return s.Executable
+	default:
+		return s.AttrPath
+	}
+}
+
+// scriptCommandLine returns the command line of a script that runs in workDir. Templates in the arguments are
+// expanded with env.
+func scriptCommandLine(config *UpdateScript, build ScriptBuild, workDir string, env *ScriptEnv) ([]string, error) {
+	switch ScriptKind(config.Kind) {
+	case "", ScriptKindBuild:
+		args, err := env.ExpandArgs(config.Args)
+		if err != nil {
+			return nil, err
+		}
+		return append([]string{path.Join(build.Output, config.Executable)}, args...), nil
+	case ScriptKindDevelop:
+		if len(config.Command) == 0 {
+			return nil, fmt.Errorf("develop script without command")
+		}
+		command, err := env.ExpandArgs(config.Command)
+		if err != nil {
+			return nil, err
+		}
+		nixBin, err := exec.LookPath("nix")
+		if err != nil {
+			return nil, fmt.Errorf("cannot find nix binary on path")
+		}
+		installable := "."
+		if config.AttrPath != "" {
+			installable = ".#" + config.AttrPath
+		}
+		return append([]string{nixBin, "develop", "-L", installable, "--command"}, command...), nil
+	case ScriptKindRepo:
+		executable := path.Clean(config.Executable)
+		if executable == "." || path.IsAbs(executable) || executable == ".." || strings.HasPrefix(executable, "../") {
+			return nil, fmt.Errorf("repo script executable=%s must be a path inside the flake root", config.Executable)
+		}
+		args, err := env.ExpandArgs(config.Args)
+		if err != nil {
+			return nil, err
+		}
+		return append([]string{path.Join(workDir, executable)}, args...), nil
+	default:
+		return nil, fmt.Errorf("unknown update script kind=%s", config.Kind)
+	}
+}
+
+// validateScripts rejects the update scripts and hooks in config that cannot run
+func validateScripts(config *FreshenConfig) error {
+	for _, task := range config.UpdateTasks {
+		for _, scripts := range [][]UpdateScript{task.PreUpdate, task.UpdateScripts, task.PostUpdate, task.PostSuccess} {
+			for _, script := range scripts {
+				// PATH is made of the path_attrs only
+				if ScriptKind(script.Kind) == ScriptKindRepo && len(script.PathAttrs) == 0 {
+					return fmt.Errorf("name=%s repo script executable=%s has no path_attrs", task.Name, script.Executable)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// RunUpdateScript runs an update script in a copy of flakeRoot and copies the files it changed back, after saving
+// their original content to snapshot. Returns the changes and what the script reported. hidden are covered if the
+// script is sandboxed.
+func RunUpdateScript(build ScriptBuild, config *UpdateScript, flakeRoot string, env *ScriptEnv, snapshot *Snapshot, hidden []string) (UpdateResult, error) {
+	if err := validateAllowedPaths(config.AllowedPaths); err != nil {
+		return UpdateResult{}, err
+	}
+	tmpDir, err := newWorkspaceDir(WorkspaceMode(config.Workspace), flakeRoot)
 	if err != nil {
-		return UpdateResult{}, fmt.Errorf("os.MkdirTemp: %w", err)
+		return UpdateResult{}, fmt.Errorf("newWorkspaceDir: %w", err)
 	}
 	defer func() {
 		_ = os.RemoveAll(tmpDir)
 	}()
-	dotGitPath := path.Join(flakeRoot, ".git")
-	copyOpts := cp.Options{
-		Skip: func(srcinfo os.FileInfo, src, dest string) (bool, error) {
-			return src == dotGitPath, nil
-		},
+	changes, err := prepareWorkspace(WorkspaceMode(config.Workspace), flakeRoot, tmpDir)
+	if err != nil {
+		return UpdateResult{}, err
 	}
-	if err := cp.Copy(flakeRoot, tmpDir, copyOpts); err != nil {
-		return UpdateResult{}, fmt.Errorf("cp.Copy: %w", err)
+	scriptEnv := *env
+	scriptEnv.FlakeRoot = tmpDir
+	resultDir, err := os.MkdirTemp("", "freshen-result")
+	if err != nil {
+		return UpdateResult{}, fmt.Errorf("os.MkdirTemp: %w", err)
 	}
-	worktree, err := prepareGit(tmpDir)
+	defer func() {
+		_ = os.RemoveAll(resultDir)
+	}()
+	scriptEnv.ResultFile = path.Join(resultDir, scriptResultFile)
+	commandLine, err := scriptCommandLine(config, build, tmpDir, &scriptEnv)
 	if err != nil {
-		return UpdateResult{}, fmt.Errorf("prepareGit: %w", err)
+		return UpdateResult{}, err
+	}
+	environ := append(os.Environ(), scriptEnv.Environ()...)
+	if ScriptKind(config.Kind) == ScriptKindRepo {
+		environ = append(environ, "PATH="+strings.Join(build.PathDirs, ":"))
 	}
-	executable := path.Join(scriptOutput, config.Executable)
+	stdout := &resultWriter{w: os.Stdout}
 	cmd := exec.Cmd{
-		Path:   executable,
-		Args:   append([]string{executable}, config.Args...),
-		Dir:    tmpDir,
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
+		Path:      commandLine[0],
+		Args:      commandLine,
+		Dir:       tmpDir,
+		Env:       environ,
+		Stdout:    stdout,
+		Stderr:    os.Stderr,
+		WaitDelay: scriptWaitDelay,
 	}
-	if err := cmd.Run(); err != nil {
+	if config.Sandbox {
+		cleanup, err := sandboxCmd(&cmd, config.Network, []string{resultDir}, hidden)
+		if err != nil {
+			return UpdateResult{}, fmt.Errorf("sandboxCmd: %w", err)
+		}
+		defer cleanup()
+	}
+	if err := cmd.Run(); errors.Is(err, exec.ErrWaitDelay) {
+		log.Printf("Update script exited with its output still open. Stopped reading it script=%s", config.name())
+	} else if err != nil {
 		return UpdateResult{}, fmt.Errorf("exec.Cmd: %w", err)
 	}
-	out, err := diffGit(worktree)
+	scriptResults, err := stdout.Results()
+	if err != nil {
+		return UpdateResult{}, err
+	}
+	fileResults, err := readScriptResult(scriptEnv.ResultFile)
 	if err != nil {
-		return UpdateResult{}, fmt.Errorf("diffGit: %w", err)
+		return UpdateResult{}, fmt.Errorf("readScriptResult: %w", err)
+	}
+	out, err := changes()
+	if err != nil {
+		return UpdateResult{}, err
+	}
+	for _, scriptResult := range append(scriptResults, fileResults...) {
+		out.addScriptResult(scriptResult)
+	}
+	if rejected := disallowedPaths(config.AllowedPaths, out); len(rejected) > 0 {
+		switch DisallowedPathAction(config.OnDisallowedPath) {
+		case "", DisallowedPathFail:
+			return UpdateResult{}, &DisallowedPathsError{Paths: rejected}
+		case DisallowedPathDrop:
+			for _, rejectedPath := range rejected {
+				log.Printf("Dropping change outside allowed_paths file=%s", rejectedPath)
+				out.dropPath(rejectedPath)
+				out.rejectPath(rejectedPath)
+			}
+		default:
+			return UpdateResult{}, fmt.Errorf("unknown on_disallowed_path=%s", config.OnDisallowedPath)
+		}
 	}
 	for _, changedPath := range out.getPathsChanged() {
+		if err := snapshot.Save(changedPath); err != nil {
+			return UpdateResult{}, fmt.Errorf("snapshot.Save: %w", err)
+		}
+		if out.isDeleted(changedPath) {
+			log.Printf("Deleting file=%s", changedPath)
+			if err := os.Remove(path.Join(flakeRoot, changedPath)); err != nil && !os.IsNotExist(err) {
+				return UpdateResult{}, fmt.Errorf("os.Remove %s: %w", changedPath, err)
+			}
+			continue
+		}
 		log.Printf("Copying updated file=%s", changedPath)
 		if err := cp.Copy(path.Join(tmpDir, changedPath), path.Join(flakeRoot, changedPath)); err != nil {
 			return UpdateResult{}, fmt.Errorf("cp.Copy %s: %w", changedPath, err)
@@ -58,13 +211,62 @@ func RunUpdateScript(scriptOutput string, config *UpdateScript, flakeRoot string
 	return out, nil
 }
 
+// prepareWorkspace copies flakeRoot to tmpDir with the given mode. changes returns the files changed in tmpDir since.
+func prepareWorkspace(mode WorkspaceMode, flakeRoot, tmpDir string) (changes func() (UpdateResult, error), err error) {
+	switch mode {
+	case WorkspaceCopy:
+		workspace, err := NewWorkspace(flakeRoot, tmpDir)
+		if err != nil {
+			return nil, fmt.Errorf("NewWorkspace: %w", err)
+		}
+		return func() (UpdateResult, error) {
+			out, err := workspace.Changes()
+			if err != nil {
+				return UpdateResult{}, fmt.Errorf("workspace.Changes: %w", err)
+			}
+			return out, nil
+		}, nil
+	case "", WorkspaceGit:
+		if err := copyFlakeRoot(flakeRoot, tmpDir); err != nil {
+			return nil, fmt.Errorf("copyFlakeRoot: %w", err)
+		}
+		worktree, err := prepareGit(tmpDir)
+		if err != nil {
+			return nil, fmt.Errorf("prepareGit: %w", err)
+		}
+		return func() (UpdateResult, error) {
+			out, err := diffGit(worktree)
+			if err != nil {
+				return UpdateResult{}, fmt.Errorf("diffGit: %w", err)
+			}
+			return out, nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown workspace=%s", mode)
+	}
+}
+
+// copyFlakeRoot copies the flake root to dest, without the .git directory
+func copyFlakeRoot(flakeRoot, dest string) error {
+	dotGitPath := path.Join(flakeRoot, ".git")
+	copyOpts := cp.Options{
+		Skip: func(srcinfo os.FileInfo, src, dest string) (bool, error) {
+			return src == dotGitPath, nil
+		},
+	}
+	if err := cp.Copy(flakeRoot, dest, copyOpts); err != nil {
+		return fmt.Errorf("cp.Copy: %w", err)
+	}
+	return nil
+}
+
 func prepareGit(root string) (*git.Worktree, error) {
 	if err := deleteGit(root); err != nil {
 		return nil, fmt.Errorf("deleteGit: %w", err)
 	}
 	fs := osfs.New(root)
 	fscache := cache.NewObjectLRU(10000)
-	storer := filesystem.NewStorage(fs, fscache)
+	storer := filesystem.NewStorage(osfs.New(path.Join(root, ".git")), fscache)
 	repo, err := git.Init(storer, fs)
 	if err != nil {
 		return nil, fmt.Errorf("git.Init: %w", err)
@@ -98,9 +300,13 @@ func diffGit(wt *git.Worktree) (UpdateResult, error) {
 		if maybeFileStatus == nil {
 			continue
 		}
-		fileStatus := *maybeFileStatus
-		if fileStatus.Worktree == git.Modified {
+		switch maybeFileStatus.Worktree {
+		case git.Modified:
 			out.addPath(filename)
+		case git.Untracked:
+			out.addNewPath(filename)
+		case git.Deleted:
+			out.deletePath(filename)
 		}
 	}
 	return out, nil
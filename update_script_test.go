@@ -0,0 +1,143 @@
+package main
+
+import (
+	"github.com/squalus/freshen/flake"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDiffGit(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, "modified.txt", "old")
+	writeTestFile(t, root, "deleted.txt", "old")
+	writeTestFile(t, root, "same.txt", "old")
+	worktree, err := prepareGit(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, root, "modified.txt", "new")
+	writeTestFile(t, root, "dir/added.txt", "new")
+	if err := os.Remove(path.Join(root, "deleted.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := diffGit(worktree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := result.getPathsChanged(), []string{"deleted.txt", "dir/added.txt", "modified.txt"}; !slices.Equal(got, want) {
+		t.Fatalf("changed=%v want=%v", got, want)
+	}
+	if !result.isAdded("dir/added.txt") || result.isAdded("modified.txt") {
+		t.Errorf("added=%v", sortedKeys(result.pathsAdded))
+	}
+	if !result.isDeleted("deleted.txt") || result.isDeleted("modified.txt") {
+		t.Errorf("deleted=%v", sortedKeys(result.pathsDeleted))
+	}
+}
+
+func TestUpdateResult_addedAndDeleted(t *testing.T) {
+	result := NewUpdateResult()
+	result.addNewPath("tmp.txt")
+	result.deletePath("tmp.txt")
+	result.deletePath("recreated.txt")
+	result.addNewPath("recreated.txt")
+
+	other := NewUpdateResult()
+	other.addNewPath("new.txt")
+	other.deletePath("gone.txt")
+	result.union(other)
+
+	if got, want := result.getPathsChanged(), []string{"gone.txt", "new.txt", "recreated.txt"}; !slices.Equal(got, want) {
+		t.Fatalf("changed=%v want=%v", got, want)
+	}
+	if got := sortedKeys(result.pathsAdded); !slices.Equal(got, []string{"new.txt"}) {
+		t.Errorf("added=%v", got)
+	}
+	if got := sortedKeys(result.pathsDeleted); !slices.Equal(got, []string{"gone.txt"}) {
+		t.Errorf("deleted=%v", got)
+	}
+}
+
+func TestRunUpdateScript_Repo(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, "scripts/update.sh", "#!/bin/sh\necho \"$PATH\" > path.txt\n")
+	if err := os.Chmod(path.Join(root, "scripts/update.sh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	script := UpdateScript{Kind: string(ScriptKindRepo), Executable: "./scripts/update.sh"}
+	build := ScriptBuild{PathDirs: []string{"/nix/store/abc-jq/bin", "/bin"}}
+	result, err := RunUpdateScript(build, &script, root, &ScriptEnv{}, NewSnapshot(root), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.isAdded("path.txt") {
+		t.Errorf("changed=%v", result.getPathsChanged())
+	}
+	buf, err := os.ReadFile(path.Join(root, "path.txt"))
+	if err != nil || string(buf) != "/nix/store/abc-jq/bin:/bin\n" {
+		t.Errorf("path.txt=%q err=%v", buf, err)
+	}
+
+	for _, executable := range []string{"../update.sh", "/bin/sh", "."} {
+		script := UpdateScript{Kind: string(ScriptKindRepo), Executable: executable}
+		if _, err := scriptCommandLine(&script, build, root, &ScriptEnv{}); err == nil {
+			t.Errorf("executable=%s want error", executable)
+		}
+	}
+	if _, err := scriptCommandLine(&UpdateScript{Kind: "other"}, build, root, &ScriptEnv{}); err == nil {
+		t.Error("want error for unknown kind")
+	}
+}
+
+func TestScriptCommandLine_Develop(t *testing.T) {
+	fakeNix(t, "exit 1")
+	nixBin, err := exec.LookPath("nix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &ScriptEnv{Inputs: map[string]ScriptInput{"foo": {Name: "foo", NewRev: "abc"}}}
+	cases := []struct {
+		name   string
+		script UpdateScript
+		want   []string
+	}{
+		{"default devShell", UpdateScript{Command: []string{"go", "get", "-u", "./..."}},
+			[]string{nixBin, "develop", "-L", ".", "--command", "go", "get", "-u", "./..."}},
+		{"named devShell", UpdateScript{AttrPath: "go", Command: []string{"go", "mod", "tidy"}},
+			[]string{nixBin, "develop", "-L", ".#go", "--command", "go", "mod", "tidy"}},
+		{"template", UpdateScript{Command: []string{"update-foo", "--rev", "{{.Inputs.foo.NewRev}}"}},
+			[]string{nixBin, "develop", "-L", ".", "--command", "update-foo", "--rev", "abc"}},
+		{"missing command", UpdateScript{AttrPath: "go"}, nil},
+		{"bad template", UpdateScript{Command: []string{"{{.Inputs.bar.NewRev}}"}}, nil},
+	}
+	for _, c := range cases {
+		c.script.Kind = string(ScriptKindDevelop)
+		got, err := scriptCommandLine(&c.script, ScriptBuild{}, t.TempDir(), env)
+		if c.want == nil {
+			if err == nil {
+				t.Errorf("%s: want error, got %v", c.name, got)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(got, c.want) {
+			t.Errorf("%s: got=%v err=%v want=%v", c.name, got, err, c.want)
+		}
+	}
+}
+
+func TestValidateScripts(t *testing.T) {
+	repoScript := UpdateScript{Kind: string(ScriptKindRepo), Executable: "scripts/update.sh"}
+	config := &FreshenConfig{UpdateTasks: []UpdateTask{{Name: "task", PostUpdate: []UpdateScript{repoScript}}}}
+	if _, err := NewUpdateSpec(config, flake.Flake{}); err == nil || !strings.Contains(err.Error(), "has no path_attrs") {
+		t.Errorf("err=%v", err)
+	}
+	config.UpdateTasks[0].PostUpdate[0].PathAttrs = []string{"coreutils"}
+	if _, err := NewUpdateSpec(config, flake.Flake{}); err != nil {
+		t.Error(err)
+	}
+}
@@ -3,28 +3,49 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/google/go-github/v48/github"
 	"github.com/squalus/freshen/flake"
 	"log"
 	"os"
 	"path"
-	"strings"
+	"time"
 )
 
 type UpdateSpec struct {
-	Flake        flake.Flake
-	Config       *FreshenConfig
-	nameToConfig map[string]*UpdateTask
+	Flake  flake.Flake
+	Config *FreshenConfig
+	Graph  *TaskGraph
+	// KeepFailed leaves the files changed by a failed task in place instead of restoring them
+	KeepFailed bool
+	// SkipBuilds skips the main build and tests of each task
+	SkipBuilds bool
+	// Changelogs fetches the upstream changelog of each changed input
+	Changelogs bool
+	// GitHub is the client for changelogs of GitHub inputs. Default: an unauthenticated client.
+	GitHub *github.Client
+	// SandboxHidden are credential files and directories that sandboxed update scripts cannot read, even if they are
+	// below a path mounted into the sandbox
+	SandboxHidden []string
+	// recorder collects the steps of the task being run, for the report
+	recorder *taskRecorder
+	// inputPaths keeps the store paths of the flake inputs between update script stages
+	inputPaths *inputPathsCache
 }
 
-func NewUpdateSpec(config *FreshenConfig, flake flake.Flake) *UpdateSpec {
-	var out UpdateSpec
-	out.Flake = flake
-	out.Config = config
-	out.nameToConfig = make(map[string]*UpdateTask, len(out.Config.UpdateTasks))
-	for i, curConfig := range config.UpdateTasks {
-		out.nameToConfig[curConfig.Name] = &config.UpdateTasks[i]
+func NewUpdateSpec(config *FreshenConfig, flake flake.Flake) (*UpdateSpec, error) {
+	graph, err := NewTaskGraph(config)
+	if err != nil {
+		return nil, fmt.Errorf("NewTaskGraph %w", err)
+	}
+	if err := validateScripts(config); err != nil {
+		return nil, err
 	}
-	return &out
+	return &UpdateSpec{
+		Flake:      flake,
+		Config:     config,
+		Graph:      graph,
+		inputPaths: &inputPathsCache{},
+	}, nil
 }
 
 type RunMode string
@@ -32,27 +53,103 @@ type RunMode string
 const RunModeOnFlakeInputChange RunMode = "on_flake_input_change"
 const RunModeAlways RunMode = "always"
 
+// RunUpdateName runs the named update task after the tasks it requires. Each task in the plan runs once.
 func (a *UpdateSpec) RunUpdateName(name string, check bool) (UpdateResult, error) {
-	config, ok := a.nameToConfig[name]
-	if !ok {
-		var names []string
-		for _, task := range a.Config.UpdateTasks {
-			names = append(names, task.Name)
+	outcomes, err := a.RunUpdateNames([]string{name}, check)
+	if err != nil {
+		return UpdateResult{}, err
+	}
+	for _, outcome := range outcomes {
+		if outcome.Name != name && outcome.Status == TaskStatusFailed {
+			return UpdateResult{}, fmt.Errorf("linkedUpdate=%s %w", outcome.Name, outcome.Err)
+		}
+		if outcome.Name == name {
+			return outcome.Result, outcome.Err
 		}
-		nameMsg := strings.Join(names, ",")
-		return UpdateResult{}, fmt.Errorf("no update config with name=%s validNames=%s", name, nameMsg)
 	}
-	log.Printf("name=%s running linked updates", config.Name)
-	out := NewUpdateResult()
-	for _, linkedUpdate := range config.RequiredUpdateTasks {
-		if config.Name == linkedUpdate {
-			return UpdateResult{}, fmt.Errorf("name=%s references self in linkedUpdates", config.Name)
+	return UpdateResult{}, fmt.Errorf("name=%s missing from plan", name)
+}
+
+// runTask runs a single update task. requiredResult holds the changes made by the tasks it requires. If the task
+// fails, the files it changed are restored unless KeepFailed is set.
+func (a *UpdateSpec) runTask(config *UpdateTask, requiredResult UpdateResult, check bool) (UpdateResult, error) {
+	snapshot, err := a.newTaskSnapshot(config)
+	if err != nil {
+		return UpdateResult{}, err
+	}
+	out, err := a.runTaskWithRecovery(config, requiredResult, check, snapshot)
+	if err != nil {
+		return UpdateResult{}, err
+	}
+	if a.Changelogs {
+		a.addChangelogs(config, &out)
+	}
+	if out.empty() && !check {
+		return out, nil
+	}
+	if err := a.runHooks(config, StepKindPostSuccess, config.PostSuccess, &out, snapshot); err != nil {
+		return UpdateResult{}, a.restoreFailed(config, snapshot, err)
+	}
+	return out, nil
+}
+
+// runTaskWithRecovery runs the steps of a task. If they fail, the task is bisected or retried one input at a time
+// when configured, otherwise the failed changes are restored.
+func (a *UpdateSpec) runTaskWithRecovery(config *UpdateTask, requiredResult UpdateResult, check bool, snapshot *Snapshot) (UpdateResult, error) {
+	out, err := a.runTaskSteps(config, requiredResult, check, snapshot)
+	if err == nil {
+		return out, nil
+	}
+	if config.Bisect && len(config.Inputs) == 1 {
+		log.Printf("name=%s failed, bisecting input: %s", config.Name, err)
+		if restoreErr := snapshot.Restore(); restoreErr != nil {
+			return UpdateResult{}, fmt.Errorf("%w (restore failed: %s)", err, restoreErr)
 		}
-		result, err := a.RunUpdateName(linkedUpdate, check)
-		if err != nil {
-			return UpdateResult{}, fmt.Errorf("linkedUpdate=%s %w", linkedUpdate, err)
+		return a.bisectInput(config, config.Inputs[0], requiredResult, check, snapshot)
+	}
+	if (config.Fallback == FallbackOneAtATime || config.Bisect) && len(config.Inputs) > 1 {
+		log.Printf("name=%s failed with all inputs updated, retrying one input at a time: %s", config.Name, err)
+		if restoreErr := snapshot.Restore(); restoreErr != nil {
+			return UpdateResult{}, fmt.Errorf("%w (restore failed: %s)", err, restoreErr)
+		}
+		return a.runInputFallback(config, requiredResult, check, snapshot)
+	}
+	return UpdateResult{}, a.restoreFailed(config, snapshot, err)
+}
+
+// restoreFailed restores the files saved in snapshot after a task failed with err, unless KeepFailed is set
+func (a *UpdateSpec) restoreFailed(config *UpdateTask, snapshot *Snapshot, err error) error {
+	if a.KeepFailed {
+		log.Printf("name=%s keeping failed state", config.Name)
+		return err
+	}
+	log.Printf("name=%s restoring files after failure", config.Name)
+	if restoreErr := snapshot.Restore(); restoreErr != nil {
+		return fmt.Errorf("%w (restore failed: %s)", err, restoreErr)
+	}
+	return err
+}
+
+// newTaskSnapshot saves the files that a task is known to change
+func (a *UpdateSpec) newTaskSnapshot(config *UpdateTask) (*Snapshot, error) {
+	snapshot := NewSnapshot(a.Flake.Path)
+	if err := snapshot.Save("flake.lock"); err != nil {
+		return nil, fmt.Errorf("snapshot %w", err)
+	}
+	for _, derivedConfig := range config.DerivedHashes {
+		if err := snapshot.Save(derivedConfig.Filename); err != nil {
+			return nil, fmt.Errorf("snapshot %w", err)
 		}
-		out.union(result)
+	}
+	return snapshot, nil
+}
+
+func (a *UpdateSpec) runTaskSteps(config *UpdateTask, requiredResult UpdateResult, check bool, snapshot *Snapshot) (UpdateResult, error) {
+	out := NewUpdateResult()
+	out.union(requiredResult)
+
+	if err := a.runHooks(config, StepKindPreUpdate, config.PreUpdate, &out, snapshot); err != nil {
+		return UpdateResult{}, err
 	}
 
 	oldLocks, err := a.Flake.MetadataLocks()
@@ -64,18 +161,43 @@ func (a *UpdateSpec) RunUpdateName(name string, check bool) (UpdateResult, error
 
 	var anyInputChanged bool
 	for _, inputName := range config.Inputs {
-		result, err := a.updateInput(inputName, oldLocks)
+		start := time.Now()
+		result, err := a.updateInput(config, inputName, oldLocks)
 		if err != nil {
+			a.recorder.add(StepKindInput, inputName, start, StepStatusFailed, err.Error())
 			return UpdateResult{}, fmt.Errorf("updateInput name=%s inputName=%s %w", config.Name, inputName, err)
 		}
 		if result == nil {
 			log.Printf("name=%s inputName=%s: no input change", config.Name, inputName)
+			a.recorder.add(StepKindInput, inputName, start, StepStatusUnchanged, "")
+			continue
+		}
+		if result.deferred != "" {
+			log.Printf("name=%s inputName=%s deferred: %s", config.Name, inputName, result.deferred)
+			a.recorder.add(StepKindInput, inputName, start, StepStatusDeferred, result.deferred)
+			out.deferInput(inputName, result.deferred)
 			continue
 		}
+		if result.heldBack != "" {
+			log.Printf("name=%s inputName=%s held back: %s", config.Name, inputName, result.heldBack)
+			out.holdBack(inputName, result.heldBack)
+			if result.new == result.old {
+				a.recorder.add(StepKindInput, inputName, start, StepStatusHeldBack, result.heldBack)
+				continue
+			}
+		}
 		log.Printf("name=%s inputName=%s %s -> %s", config.Name, inputName, result.old, result.new)
+		a.recorder.add(StepKindInput, inputName, start, StepStatusChanged, result.old+" -> "+result.new)
+		out.changeInput(inputName, result.old, result.new)
 		anyInputChanged = true
 	}
 
+	return a.runStepsAfterInputs(config, out, anyInputChanged, check, snapshot)
+}
+
+// runStepsAfterInputs runs the derived hash updates, update scripts, main build and tests of a task once its
+// inputs are locked. out holds the changes made so far.
+func (a *UpdateSpec) runStepsAfterInputs(config *UpdateTask, out UpdateResult, anyInputChanged bool, check bool, snapshot *Snapshot) (UpdateResult, error) {
 	var derivedHashes []UpdateDerivedConfig
 	var updateScripts []UpdateScript
 
@@ -116,7 +238,7 @@ func (a *UpdateSpec) RunUpdateName(name string, check bool) (UpdateResult, error
 
 	log.Printf("name=%s running update scripts", config.Name)
 	if len(updateScripts) > 0 {
-		updateScriptResult, err := a.runUpdateScripts(config)
+		updateScriptResult, err := a.runUpdateScripts(config, StepKindUpdateScript, config.UpdateScripts, out, snapshot)
 		if err != nil {
 			return UpdateResult{}, fmt.Errorf("updateScriptResult: attrPath=%s %w", config.MainAttrPath, err)
 		}
@@ -130,21 +252,33 @@ func (a *UpdateSpec) RunUpdateName(name string, check bool) (UpdateResult, error
 		return UpdateResult{}, nil
 	}
 
+	if err := a.runHooks(config, StepKindPostUpdate, config.PostUpdate, &out, snapshot); err != nil {
+		return UpdateResult{}, err
+	}
+
+	if a.SkipBuilds {
+		log.Printf("name=%s skipping main build and tests", config.Name)
+		return out, nil
+	}
+
 	if config.MainAttrPath == "" {
 		log.Printf("name=%s no main derivation", config.Name)
 	} else {
 		log.Printf("name=%s building main derivation", config.Name)
-		if _, _, err = a.Flake.BuildWithRawOutput(config.MainAttrPath, true); err != nil {
+		start := time.Now()
+		fixupResult, err := a.buildWithHashFixup(config, config.MainAttrPath, true, config.Retry, snapshot)
+		a.recorder.addResult(StepKindBuild, config.MainAttrPath, start, err)
+		out.union(fixupResult)
+		if err != nil {
 			return UpdateResult{}, fmt.Errorf("name=%s main derivation build failed %w", config.Name, err)
 		}
 	}
 
-	log.Printf("name=%s building tests", config.Name)
-	for _, testConfig := range config.Tests {
-		log.Printf("name=%s building test attrPath=%s", config.Name, testConfig.AttrPath)
-		if _, _, err = a.Flake.BuildWithRawOutput(testConfig.AttrPath, !testConfig.DisableSandbox); err != nil {
-			return UpdateResult{}, fmt.Errorf("name=%s testAttrPath=%s test failed %w", config.Name, testConfig.AttrPath, err)
-		}
+	log.Printf("name=%s running tests", config.Name)
+	testsResult, err := a.runTests(config, snapshot)
+	out.union(testsResult)
+	if err != nil {
+		return UpdateResult{}, fmt.Errorf("name=%s %w", config.Name, err)
 	}
 	return out, nil
 }
@@ -152,29 +286,60 @@ func (a *UpdateSpec) RunUpdateName(name string, check bool) (UpdateResult, error
 func (a *UpdateSpec) updateDerivedHashes(config *UpdateTask) (UpdateResult, error) {
 	out := NewUpdateResult()
 	for _, derivedConfig := range config.DerivedHashes {
+		start := time.Now()
 		result, err := a.updatedDerivedHash(derivedConfig)
 		if err != nil {
+			a.recorder.add(StepKindDerivedHash, derivedConfig.Filename, start, StepStatusFailed, err.Error())
 			return NewUpdateResult(), fmt.Errorf("updateDerivedHash: %w", err)
 		}
 		if result == nil {
 			log.Printf("name=%s derivedAttrPath=%s no change", config.Name, derivedConfig.AttrPath)
+			a.recorder.add(StepKindDerivedHash, derivedConfig.Filename, start, StepStatusUnchanged, "")
 			continue
 		}
 		log.Printf("name=%s derivedAttrPath=%s %s -> %s", config.Name, derivedConfig.AttrPath, result.old, result.new)
+		a.recorder.add(StepKindDerivedHash, derivedConfig.Filename, start, StepStatusChanged, result.old+" -> "+result.new)
 		out.addPaths(result.pathsChanged)
+		out.changeHash(derivedConfig.Filename, result.old, result.new)
 	}
 	return out, nil
 }
 
-func (a *UpdateSpec) runUpdateScripts(config *UpdateTask) (UpdateResult, error) {
+// runHooks runs the hooks of one stage of a task and adds the files they changed to out
+func (a *UpdateSpec) runHooks(config *UpdateTask, stage StepKind, hooks []UpdateScript, out *UpdateResult, snapshot *Snapshot) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+	log.Printf("name=%s running %s hooks", config.Name, stage)
+	hookResult, err := a.runUpdateScripts(config, stage, hooks, *out, snapshot)
+	if err != nil {
+		return fmt.Errorf("name=%s %s hook %w", config.Name, stage, err)
+	}
+	out.union(hookResult)
+	return nil
+}
+
+// runUpdateScripts runs scripts in order. Used for the update scripts and the hooks of a task. kind is the step
+// kind the scripts are reported as. current holds the changes made so far, which the scripts can see.
+func (a *UpdateSpec) runUpdateScripts(config *UpdateTask, kind StepKind, scripts []UpdateScript, current UpdateResult, snapshot *Snapshot) (UpdateResult, error) {
 	out := NewUpdateResult()
-	for _, updateScript := range config.UpdateScripts {
-		log.Printf("name=%s running update script attrPath=%s executable=%s args=%s", config.Name, updateScript.AttrPath, updateScript.Executable, updateScript.Args)
-		scriptOutput, err := a.Flake.Build(updateScript.AttrPath)
+	if len(scripts) == 0 {
+		return out, nil
+	}
+	env, err := a.newScriptEnv(config, current, a.scriptInputPaths(config, current))
+	if err != nil {
+		return NewUpdateResult(), err
+	}
+	for _, updateScript := range scripts {
+		start := time.Now()
+		log.Printf("name=%s running update script kind=%s attrPath=%s executable=%s command=%s args=%s", config.Name, updateScript.Kind, updateScript.AttrPath, updateScript.Executable, updateScript.Command, updateScript.Args)
+		build, err := a.buildScript(&updateScript)
 		if err != nil {
-			return NewUpdateResult(), fmt.Errorf("flake.Build attrPath=%s: %w", updateScript.AttrPath, err)
+			a.recorder.addChange(kind, updateScript.name(), start, UpdateResult{}, err)
+			return NewUpdateResult(), err
 		}
-		scriptOut, err := RunUpdateScript(scriptOutput, &updateScript, a.Flake.Path)
+		scriptOut, err := RunUpdateScript(build, &updateScript, a.Flake.Path, env, snapshot, a.SandboxHidden)
+		a.recorder.addChange(kind, updateScript.name(), start, scriptOut, err)
 		if err != nil {
 			return NewUpdateResult(), fmt.Errorf("RunUpdateScript: %w", err)
 		}
@@ -183,20 +348,50 @@ func (a *UpdateSpec) runUpdateScripts(config *UpdateTask) (UpdateResult, error)
 	return out, nil
 }
 
+// buildScript builds the attrs an update script needs: the script itself, or the PathAttrs of a repo script
+func (a *UpdateSpec) buildScript(config *UpdateScript) (ScriptBuild, error) {
+	var out ScriptBuild
+	switch ScriptKind(config.Kind) {
+	case "", ScriptKindBuild:
+		scriptOutput, err := a.Flake.Build(config.AttrPath)
+		if err != nil {
+			return ScriptBuild{}, fmt.Errorf("flake.Build attrPath=%s: %w", config.AttrPath, err)
+		}
+		out.Output = scriptOutput
+	case ScriptKindRepo:
+		for _, attrPath := range config.PathAttrs {
+			attrOutput, err := a.Flake.Build(attrPath)
+			if err != nil {
+				return ScriptBuild{}, fmt.Errorf("flake.Build attrPath=%s: %w", attrPath, err)
+			}
+			out.PathDirs = append(out.PathDirs, path.Join(attrOutput, "bin"))
+		}
+	}
+	return out, nil
+}
+
 type UpdateInputResult struct {
 	old, new     string
 	pathsChanged []string
+	// deferred is the reason an input update was not applied yet
+	deferred string
+	// heldBack is the reason an input was not moved to its newest revision
+	heldBack string
 }
 
-func (a *UpdateSpec) updateInput(name string, oldLocks flake.Locks) (*UpdateInputResult, error) {
+func (a *UpdateSpec) updateInput(config *UpdateTask, name string, oldLocks flake.Locks) (*UpdateInputResult, error) {
 	oldRev, ok := oldLocks.InputRev(name)
 	if !ok {
 		return nil, fmt.Errorf("missing input in lock file: %s", name)
 	}
 	var out UpdateInputResult
 	out.old = oldRev
-	if err := a.Flake.UpdateInput(name); err != nil {
-		return nil, fmt.Errorf("flake.UpdateInput: %w", err)
+	lockSnapshot := NewSnapshot(a.Flake.Path)
+	if err := lockSnapshot.Save("flake.lock"); err != nil {
+		return nil, fmt.Errorf("snapshot: %w", err)
+	}
+	if err := a.lockNewest(config, name, oldLocks); err != nil {
+		return nil, fmt.Errorf("lockNewest: %w", err)
 	}
 	newLocks, err := a.Flake.MetadataLocks()
 	if err != nil {
@@ -210,18 +405,44 @@ func (a *UpdateSpec) updateInput(name string, oldLocks flake.Locks) (*UpdateInpu
 	if oldRev == out.new {
 		return nil, nil
 	}
+
+	agedRev, err := a.applyMinAge(config, name, oldLocks, newLocks)
+	if err != nil {
+		return nil, fmt.Errorf("applyMinAge: %w", err)
+	}
+	if agedRev == "" || agedRev == oldRev {
+		if err := lockSnapshot.Restore(); err != nil {
+			return nil, fmt.Errorf("restore lock file: %w", err)
+		}
+		out.deferred = fmt.Sprintf("rev=%s is younger than min_age and no older commit qualifies", out.new)
+		out.new = oldRev
+		return &out, nil
+	}
+	out.new = agedRev
+
+	allowedRev, rule, err := a.applyDenyList(config, name, oldLocks, out.new)
+	if err != nil {
+		return nil, fmt.Errorf("applyDenyList: %w", err)
+	}
+	if allowedRev == "" || allowedRev == oldRev {
+		if err := lockSnapshot.Restore(); err != nil {
+			return nil, fmt.Errorf("restore lock file: %w", err)
+		}
+		out.heldBack = fmt.Sprintf("rev=%s denied by %s", out.new, rule)
+		out.new = oldRev
+		return &out, nil
+	}
+	if allowedRev != out.new {
+		out.heldBack = fmt.Sprintf("pinned to rev=%s because rev=%s is denied by %s", allowedRev, out.new, rule)
+		out.new = allowedRev
+	}
 	return &out, nil
 }
 
 func (a *UpdateSpec) updatedDerivedHash(config UpdateDerivedConfig) (*UpdateInputResult, error) {
-	_, stderr, err := a.Flake.BuildWithRawOutput(config.AttrPath, true)
-	if err == nil {
-		return nil, fmt.Errorf("build unexpectedly succeeded")
-	}
-
-	hashMismatchResult, err := FindHashMismatch(stderr)
+	hashMismatchResult, err := a.buildHashMismatch(config.AttrPath)
 	if err != nil {
-		return nil, fmt.Errorf("findHashMismatchResult %w", err)
+		return nil, err
 	}
 	var out UpdateInputResult
 	out.new = hashMismatchResult.Got
@@ -240,9 +461,42 @@ func (a *UpdateSpec) updatedDerivedHash(config UpdateDerivedConfig) (*UpdateInpu
 		return nil, fmt.Errorf("writeJsonStringFile hashFilePath=%s %w", hashFilePath, err)
 	}
 	out.pathsChanged = []string{config.Filename}
+
+	if config.VerifyReproducible {
+		if err := a.verifyReproducible(config, out.new); err != nil {
+			return nil, err
+		}
+	}
 	return &out, nil
 }
 
+// buildHashMismatch builds a mismatch attrPath and extracts the hash mismatch from its output
+func (a *UpdateSpec) buildHashMismatch(attrPath string) (HashMismatchResult, error) {
+	_, stderr, err := a.Flake.BuildWithRawOutput(attrPath, true)
+	if err == nil {
+		return HashMismatchResult{}, fmt.Errorf("build unexpectedly succeeded")
+	}
+	hashMismatchResult, err := FindHashMismatch(stderr)
+	if err != nil {
+		return HashMismatchResult{}, fmt.Errorf("findHashMismatchResult %w", err)
+	}
+	return hashMismatchResult, nil
+}
+
+// verifyReproducible realises the mismatch attrPath a second time. The failed fixed-output derivation is never
+// registered in the store, so the second build fetches again and must arrive at the same hash.
+func (a *UpdateSpec) verifyReproducible(config UpdateDerivedConfig, hash string) error {
+	log.Printf("derivedAttrPath=%s verifying reproducibility", config.AttrPath)
+	second, err := a.buildHashMismatch(config.AttrPath)
+	if err != nil {
+		return fmt.Errorf("verifyReproducible attrPath=%s %w", config.AttrPath, err)
+	}
+	if second.Got != hash {
+		return fmt.Errorf("derivedAttrPath=%s is not reproducible: first=%s second=%s", config.AttrPath, hash, second.Got)
+	}
+	return nil
+}
+
 func readJsonStringFile(path string) (out string, err error) {
 	buf, err := os.ReadFile(path)
 	if err != nil {
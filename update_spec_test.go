@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/squalus/freshen/flake"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// hookTestNix is a fake nix for tasks with scripts and hooks. Scripts build to /bin, behind the /nix/store prefix
+// that outputs are checked for. The main build fails when a and b are both updated.
+const hookTestNix = `case "$1 $2" in
+"flake lock") sed -i "s/\"$4-old\"/\"$4-new\"/" flake.lock ;;
+"build --json") echo '[{"outputs": {"out": "/nix/store/../../bin"}}]' ;;
+"build -L") if grep -q a-new flake.lock && grep -q b-new flake.lock; then echo "error: builder for '/nix/store/abc-default.drv' failed with exit code 1" >&2; exit 1; fi ;;
+esac`
+
+// shScript is a script that runs command with sh
+func shScript(command string) UpdateScript {
+	return UpdateScript{AttrPath: "script", Executable: "sh", Args: []string{"-c", command}}
+}
+
+func TestRunTask_Hooks(t *testing.T) {
+	fakeNix(t, hookTestNix)
+	root := t.TempDir()
+	writeTestFile(t, root, "flake.lock", fallbackTestLock)
+	config := &UpdateTask{
+		Name:          "task",
+		Inputs:        []string{"a"},
+		MainAttrPath:  "default",
+		PreUpdate:     []UpdateScript{shScript("echo pre_update >> order.txt")},
+		UpdateScripts: []UpdateScript{shScript("echo update_script >> order.txt")},
+		PostUpdate:    []UpdateScript{shScript("echo post_update >> order.txt")},
+		PostSuccess:   []UpdateScript{shScript("echo post_success >> order.txt && echo done > success.txt")},
+	}
+	spec := &UpdateSpec{Flake: flake.Flake{Path: root}, Config: &FreshenConfig{}}
+	result, err := spec.runTask(config, NewUpdateResult(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(path.Join(root, "order.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order := strings.Fields(string(buf)); !slices.Equal(order, []string{"pre_update", "update_script", "post_update", "post_success"}) {
+		t.Errorf("order=%v", order)
+	}
+	if changed := result.getPathsChanged(); !slices.Equal(changed, []string{"flake.lock", "order.txt", "success.txt"}) {
+		t.Errorf("changed=%v", changed)
+	}
+}
+
+func TestRunTask_PostSuccessFailureRestores(t *testing.T) {
+	fakeNix(t, hookTestNix)
+	for _, fallback := range []bool{false, true} {
+		root := t.TempDir()
+		writeTestFile(t, root, "flake.lock", fallbackTestLock)
+		writeTestFile(t, root, "version.txt", "1.2")
+		config := &UpdateTask{
+			Name:         "task",
+			Inputs:       []string{"a"},
+			MainAttrPath: "default",
+			// with the fallback, only the run that updates a on its own changes version.txt
+			UpdateScripts: []UpdateScript{shScript("grep -q b-new flake.lock || echo 1.3 > version.txt")},
+			PostSuccess:   []UpdateScript{shScript("exit 1")},
+		}
+		if fallback {
+			// a and b fail together, so the task falls back to updating one input at a time and keeps a
+			config.Inputs = []string{"a", "b"}
+			config.Fallback = FallbackOneAtATime
+		}
+		spec := &UpdateSpec{Flake: flake.Flake{Path: root}, Config: &FreshenConfig{}}
+		if _, err := spec.runTask(config, NewUpdateResult(), false); err == nil || !strings.Contains(err.Error(), "post_success hook") {
+			t.Fatalf("fallback=%v err=%v", fallback, err)
+		}
+		for relPath, want := range map[string]string{"flake.lock": fallbackTestLock, "version.txt": "1.2"} {
+			if buf, err := os.ReadFile(path.Join(root, relPath)); err != nil || string(buf) != want {
+				t.Errorf("fallback=%v %s=%q err=%v want=%q", fallback, relPath, buf, err, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/squalus/freshen/flake"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UpstreamCommit is a commit in the upstream repository of a flake input
+type UpstreamCommit struct {
+	Rev     string
+	Time    time.Time
+	Subject string
+}
+
+// upstreamGitURL returns the URL of the git repository behind a locked input
+func upstreamGitURL(info flake.LockInfo) (string, error) {
+	switch info.Type {
+	case "github", "gitlab", "sourcehut":
+		host := info.Host
+		if host == "" {
+			host = map[string]string{"github": "github.com", "gitlab": "gitlab.com", "sourcehut": "git.sr.ht"}[info.Type]
+		}
+		return fmt.Sprintf("https://%s/%s/%s", host, info.Owner, info.Repo), nil
+	case "git":
+		if info.URL == "" {
+			return "", fmt.Errorf("git input without url")
+		}
+		return strings.TrimPrefix(info.URL, "git+"), nil
+	default:
+		return "", fmt.Errorf("input type=%s is not a git repository", info.Type)
+	}
+}
+
+// upstreamFlakeRef returns a flake reference to the upstream repository of a locked input at ref, which can be a
+// revision, branch or tag
+func upstreamFlakeRef(info flake.LockInfo, ref string) (string, error) {
+	switch info.Type {
+	case "github", "gitlab", "sourcehut":
+		out := fmt.Sprintf("%s:%s/%s/%s", info.Type, info.Owner, info.Repo, ref)
+		if info.Host != "" {
+			out += "?host=" + info.Host
+		}
+		return out, nil
+	case "git":
+		gitURL, err := upstreamGitURL(info)
+		if err != nil {
+			return "", err
+		}
+		sep := "?"
+		if strings.Contains(gitURL, "?") {
+			sep = "&"
+		}
+		if isRev(ref) {
+			return fmt.Sprintf("git+%s%srev=%s", gitURL, sep, ref), nil
+		}
+		return fmt.Sprintf("git+%s%sref=%s", gitURL, sep, ref), nil
+	default:
+		return "", fmt.Errorf("input type=%s is not a git repository", info.Type)
+	}
+}
+
+func isRev(ref string) bool {
+	if len(ref) != 40 {
+		return false
+	}
+	for _, c := range ref {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// upstreamFetchDepth is the number of commits that listUpstreamCommits fetches first. The history is deepened by
+// doubling amounts until it reaches the old revision.
+const upstreamFetchDepth = 100
+
+// listUpstreamCommits returns the first-parent commits after oldRev up to and including newRev, oldest first. Only
+// commits are fetched, and only as deep as needed to reach oldRev.
+func listUpstreamCommits(info flake.LockInfo, oldRev, newRev string) ([]UpstreamCommit, error) {
+	gitURL, err := upstreamGitURL(info)
+	if err != nil {
+		return nil, err
+	}
+	gitDir, err := os.MkdirTemp("", "")
+	if err != nil {
+		return nil, fmt.Errorf("os.MkdirTemp: %w", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(gitDir)
+	}()
+	if _, err := runGit(gitDir, "init", "--bare", "--quiet"); err != nil {
+		return nil, err
+	}
+	fetch := func(depthArg string) error {
+		_, err := runGit(gitDir, "fetch", "--quiet", "--no-tags", "--filter=tree:0", depthArg, gitURL, newRev)
+		return err
+	}
+	if err := fetch(fmt.Sprintf("--depth=%d", upstreamFetchDepth)); err != nil {
+		return nil, err
+	}
+	for depth := upstreamFetchDepth; ; depth *= 2 {
+		// looking up a missing object would fetch it from the remote. rev-list only walks the fetched commits.
+		fetched, err := runGit(gitDir, "rev-list", newRev)
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(strings.Fields(fetched), oldRev) {
+			break
+		}
+		shallow, err := runGit(gitDir, "rev-parse", "--is-shallow-repository")
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(shallow) != "true" {
+			// the full history is fetched and oldRev is not in it. git log reports it.
+			break
+		}
+		if err := fetch(fmt.Sprintf("--deepen=%d", depth)); err != nil {
+			return nil, err
+		}
+	}
+	gitLog, err := runGit(gitDir, "log", "--first-parent", "--reverse", "--format=%H %ct %s", oldRev+".."+newRev)
+	if err != nil {
+		return nil, err
+	}
+	return parseUpstreamLog(gitLog)
+}
+
+// upstreamTagTimes returns the commit time of each tag, by tag name. Only the tagged commits are fetched.
+func upstreamTagTimes(info flake.LockInfo, tags []UpstreamTag) (map[string]time.Time, error) {
+	out := make(map[string]time.Time, len(tags))
+	if len(tags) == 0 {
+		return out, nil
+	}
+	gitURL, err := upstreamGitURL(info)
+	if err != nil {
+		return nil, err
+	}
+	gitDir, err := os.MkdirTemp("", "")
+	if err != nil {
+		return nil, fmt.Errorf("os.MkdirTemp: %w", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(gitDir)
+	}()
+	if _, err := runGit(gitDir, "init", "--bare", "--quiet"); err != nil {
+		return nil, err
+	}
+	fetchArgs := []string{"fetch", "--quiet", "--no-tags", "--depth=1", "--filter=tree:0", gitURL}
+	for _, tag := range tags {
+		fetchArgs = append(fetchArgs, "+refs/tags/"+tag.Name+":refs/tags/"+tag.Name)
+	}
+	if _, err := runGit(gitDir, fetchArgs...); err != nil {
+		return nil, err
+	}
+	// annotated tags have the commit time in *committerdate, lightweight tags in committerdate
+	refs, err := runGit(gitDir, "for-each-ref", "--format=%(refname:strip=2) %(*committerdate:unix) %(committerdate:unix)", "refs/tags")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(refs), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		unixTime, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("git for-each-ref time: %w", err)
+		}
+		out[fields[0]] = time.Unix(unixTime, 0)
+	}
+	return out, nil
+}
+
+// parseUpstreamLog parses git log output in the format "%H %ct %s"
+func parseUpstreamLog(gitLog string) ([]UpstreamCommit, error) {
+	var out []UpstreamCommit
+	for _, line := range strings.Split(strings.TrimSpace(gitLog), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("unexpected git log line: %s", line)
+		}
+		unixTime, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("git log time: %w", err)
+		}
+		commit := UpstreamCommit{Rev: fields[0], Time: time.Unix(unixTime, 0)}
+		if len(fields) == 3 {
+			commit.Subject = fields[2]
+		}
+		out = append(out, commit)
+	}
+	return out, nil
+}
+
+func runGit(dir string, args ...string) (string, error) {
+	gitBin, err := exec.LookPath("git")
+	if err != nil {
+		return "", fmt.Errorf("cannot find git binary on path")
+	}
+	var stdoutBuf bytes.Buffer
+	cmd := exec.Cmd{
+		Path:   gitBin,
+		Dir:    dir,
+		Args:   append([]string{"git"}, args...),
+		Stdout: &stdoutBuf,
+		Stderr: os.Stderr,
+	}
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return stdoutBuf.String(), nil
+}
+
+// UpstreamTag is a tag in the upstream repository of a flake input
+type UpstreamTag struct {
+	Name string
+	// Rev is the commit the tag points to
+	Rev string
+}
+
+// listUpstreamTags lists the tags of the git repository behind a locked input
+func listUpstreamTags(info flake.LockInfo) ([]UpstreamTag, error) {
+	gitURL, err := upstreamGitURL(info)
+	if err != nil {
+		return nil, err
+	}
+	out, err := runGit("", "ls-remote", "--tags", gitURL)
+	if err != nil {
+		return nil, err
+	}
+	var tags []UpstreamTag
+	index := make(map[string]int)
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "refs/tags/") {
+			continue
+		}
+		name := strings.TrimPrefix(fields[1], "refs/tags/")
+		// annotated tags are listed twice. the peeled line has the commit.
+		peeled := strings.HasSuffix(name, "^{}")
+		name = strings.TrimSuffix(name, "^{}")
+		if i, ok := index[name]; ok {
+			if peeled {
+				tags[i].Rev = fields[0]
+			}
+			continue
+		}
+		index[name] = len(tags)
+		tags = append(tags, UpstreamTag{Name: name, Rev: fields[0]})
+	}
+	return tags, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"github.com/squalus/freshen/flake"
+	"strings"
+	"testing"
+)
+
+const testRev = "0123456789abcdef0123456789abcdef01234567"
+
+func TestUpstreamGitURL(t *testing.T) {
+	cases := []struct {
+		info flake.LockInfo
+		want string
+	}{
+		{flake.LockInfo{Type: "github", Owner: "NixOS", Repo: "nixpkgs"}, "https://github.com/NixOS/nixpkgs"},
+		{flake.LockInfo{Type: "gitlab", Owner: "foo", Repo: "bar", Host: "gitlab.example.com"}, "https://gitlab.example.com/foo/bar"},
+		{flake.LockInfo{Type: "sourcehut", Owner: "~foo", Repo: "bar"}, "https://git.sr.ht/~foo/bar"},
+		{flake.LockInfo{Type: "git", URL: "https://example.com/foo.git"}, "https://example.com/foo.git"},
+		{flake.LockInfo{Type: "git", URL: "git+ssh://git@example.com/foo.git"}, "ssh://git@example.com/foo.git"},
+	}
+	for _, c := range cases {
+		got, err := upstreamGitURL(c.info)
+		if err != nil || got != c.want {
+			t.Errorf("info=%+v got=%s err=%v want=%s", c.info, got, err, c.want)
+		}
+	}
+	for _, info := range []flake.LockInfo{{Type: "git"}, {Type: "tarball", URL: "https://example.com/foo.tar.gz"}, {Type: "path"}} {
+		if _, err := upstreamGitURL(info); err == nil {
+			t.Errorf("info=%+v want error", info)
+		}
+	}
+}
+
+func TestUpstreamFlakeRef(t *testing.T) {
+	cases := []struct {
+		info flake.LockInfo
+		ref  string
+		want string
+	}{
+		{flake.LockInfo{Type: "github", Owner: "NixOS", Repo: "nixpkgs"}, "nixos-unstable", "github:NixOS/nixpkgs/nixos-unstable"},
+		{flake.LockInfo{Type: "gitlab", Owner: "foo", Repo: "bar", Host: "gitlab.example.com"}, testRev, "gitlab:foo/bar/" + testRev + "?host=gitlab.example.com"},
+		{flake.LockInfo{Type: "git", URL: "https://example.com/foo.git"}, "refs/tags/v1.0", "git+https://example.com/foo.git?ref=refs/tags/v1.0"},
+		{flake.LockInfo{Type: "git", URL: "https://example.com/foo.git"}, testRev, "git+https://example.com/foo.git?rev=" + testRev},
+		{flake.LockInfo{Type: "git", URL: "https://example.com/foo.git?dir=sub"}, "main", "git+https://example.com/foo.git?dir=sub&ref=main"},
+	}
+	for _, c := range cases {
+		got, err := upstreamFlakeRef(c.info, c.ref)
+		if err != nil || got != c.want {
+			t.Errorf("info=%+v ref=%s got=%s err=%v want=%s", c.info, c.ref, got, err, c.want)
+		}
+	}
+	if _, err := upstreamFlakeRef(flake.LockInfo{Type: "path", URL: "/src"}, "main"); err == nil {
+		t.Error("want error for path input")
+	}
+}
+
+func TestIsRev(t *testing.T) {
+	cases := map[string]bool{
+		testRev:            true,
+		testRev[:39]:       false,
+		testRev + "0":      false,
+		"main":             false,
+		"refs/tags/v1.0":   false,
+		testRev[:39] + "A": false,
+		testRev[:39] + "g": false,
+	}
+	for ref, want := range cases {
+		if got := isRev(ref); got != want {
+			t.Errorf("ref=%s got=%v want=%v", ref, got, want)
+		}
+	}
+}
+
+func TestListUpstreamCommits(t *testing.T) {
+	upstream := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		out, err := runGit(upstream, append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(out)
+	}
+	git("init", "-q", "-b", "main")
+	var revs []string
+	for i := 0; i <= 2*upstreamFetchDepth+50; i++ {
+		git("commit", "-q", "--allow-empty", "-m", fmt.Sprintf("commit %d", i))
+		revs = append(revs, git("rev-parse", "HEAD"))
+	}
+	info := flake.LockInfo{Type: "git", URL: "file://" + upstream}
+	newest := len(revs) - 1
+	// within the first fetch, after one deepen and after all of the history
+	for _, old := range []int{newest - 10, newest - upstreamFetchDepth - 10, 0} {
+		commits, err := listUpstreamCommits(info, revs[old], revs[newest])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(commits) != newest-old || commits[0].Rev != revs[old+1] || commits[len(commits)-1].Rev != revs[newest] {
+			t.Errorf("old=%d commits=%d", old, len(commits))
+		}
+	}
+	if _, err := listUpstreamCommits(info, testRev, revs[newest]); err == nil {
+		t.Error("want error for a revision that is not upstream")
+	}
+}
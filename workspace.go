@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// WorkspaceMode is how an update script's copy of the flake root is made and how its changes are found
+type WorkspaceMode string
+
+// WorkspaceCopy copies the files, with reflinks where the filesystem supports them, and finds changes by comparing
+// file metadata and then content
+const WorkspaceCopy WorkspaceMode = "copy"
+
+// WorkspaceGit copies the files into a new git repository with every file staged and finds changes with git status.
+// This is the default.
+const WorkspaceGit WorkspaceMode = "git"
+
+// workspaceMtimeWindow is how close to the start of copying a file's mtime must be for the file to be compared by
+// content even if its mtime did not change. Filesystem timestamps are coarser than the clock, so a file written
+// right after it was copied can keep the same mtime.
+const workspaceMtimeWindow = 2 * time.Second
+
+// newWorkspaceDir creates an empty directory for the copy of flakeRoot. A copy workspace is created next to flakeRoot,
+// so that both are on the same filesystem and reflinks work. A git workspace copies every file anyway and is created
+// in the system temporary directory, as is a copy workspace if the parent directory is not writable.
+func newWorkspaceDir(mode WorkspaceMode, flakeRoot string) (string, error) {
+	if mode == WorkspaceCopy {
+		absRoot, err := filepath.Abs(flakeRoot)
+		if err != nil {
+			return "", fmt.Errorf("filepath.Abs: %w", err)
+		}
+		dir, err := os.MkdirTemp(path.Dir(absRoot), ".freshen-workspace-")
+		if err == nil {
+			return dir, nil
+		}
+	}
+	dir, err := os.MkdirTemp("", "freshen-workspace-")
+	if err != nil {
+		return "", fmt.Errorf("os.MkdirTemp: %w", err)
+	}
+	return dir, nil
+}
+
+// Workspace is a copy of a flake root that remembers the state of every file it copied
+type Workspace struct {
+	src, dir string
+	// files by path relative to dir
+	files map[string]workspaceFile
+	// start is when copying began. Files with an mtime after or close to it, see workspaceMtimeWindow, could change
+	// without a visible mtime change.
+	start time.Time
+	// reflink is false once the filesystem refused to clone a file
+	reflink bool
+}
+
+type workspaceFile struct {
+	size  int64
+	mode  fs.FileMode
+	mtime time.Time
+	// target of a symlink
+	link string
+}
+
+// NewWorkspace copies src to the existing directory dir, without the .git directory. File contents are cloned if
+// src and dir are on a filesystem that supports reflinks, and copied otherwise. Modification times are kept.
+func NewWorkspace(src, dir string) (*Workspace, error) {
+	w := &Workspace{src: src, dir: dir, files: make(map[string]workspaceFile), start: time.Now(), reflink: true}
+	err := filepath.WalkDir(src, func(srcPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(src, srcPath)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+		if relPath == ".git" {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		destPath := path.Join(dir, relPath)
+		switch {
+		case info.IsDir():
+			// stay writable so the directory can be filled
+			return os.Mkdir(destPath, info.Mode().Perm()|0700)
+		case info.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(srcPath)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(target, destPath); err != nil {
+				return err
+			}
+			w.files[relPath] = workspaceFile{mode: info.Mode(), link: target}
+			return nil
+		case info.Mode().IsRegular():
+			if err := w.copyFile(srcPath, destPath, info); err != nil {
+				return fmt.Errorf("copy %s: %w", relPath, err)
+			}
+			w.files[relPath] = workspaceFile{size: info.Size(), mode: info.Mode(), mtime: info.ModTime()}
+			return nil
+		default:
+			// sockets, pipes and devices are not part of a flake
+			return nil
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("filepath.WalkDir: %w", err)
+	}
+	return w, nil
+}
+
+func (w *Workspace) copyFile(srcPath, destPath string, info fs.FileInfo) error {
+	srcFile, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = srcFile.Close()
+	}()
+	destFile, err := os.OpenFile(destPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	copied := false
+	if w.reflink {
+		if err := reflink(destFile, srcFile); err == nil {
+			copied = true
+		} else {
+			w.reflink = false
+		}
+	}
+	if !copied {
+		if _, err := io.Copy(destFile, srcFile); err != nil {
+			_ = destFile.Close()
+			return err
+		}
+	}
+	if err := destFile.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(destPath, info.ModTime(), info.ModTime())
+}
+
+// Changes compares the workspace with the state it was copied in. Files whose size, mode, symlink target or mtime
+// differ are compared by content with the original. Files ignored by .gitignore are not reported.
+func (w *Workspace) Changes() (UpdateResult, error) {
+	patterns, err := gitignore.ReadPatterns(osfs.New(w.dir), nil)
+	if err != nil {
+		return UpdateResult{}, fmt.Errorf("gitignore.ReadPatterns: %w", err)
+	}
+	ignored := gitignore.NewMatcher(patterns)
+	out := NewUpdateResult()
+	seen := make(map[string]struct{}, len(w.files))
+	err = filepath.WalkDir(w.dir, func(curPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(w.dir, curPath)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+		if relPath == ".git" || ignored.Match(strings.Split(relPath, "/"), entry.IsDir()) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() && info.Mode()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		seen[relPath] = struct{}{}
+		original, ok := w.files[relPath]
+		if !ok {
+			out.addNewPath(relPath)
+			return nil
+		}
+		changed, err := w.changed(relPath, original, info)
+		if err != nil {
+			return err
+		}
+		if changed {
+			out.addPath(relPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return UpdateResult{}, fmt.Errorf("filepath.WalkDir: %w", err)
+	}
+	for relPath := range w.files {
+		if _, ok := seen[relPath]; ok {
+			continue
+		}
+		if ignored.Match(strings.Split(relPath, "/"), false) {
+			continue
+		}
+		out.deletePath(relPath)
+	}
+	return out, nil
+}
+
+func (w *Workspace) changed(relPath string, original workspaceFile, info fs.FileInfo) (bool, error) {
+	if info.Mode() != original.mode {
+		return true, nil
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		target, err := os.Readlink(path.Join(w.dir, relPath))
+		if err != nil {
+			return false, err
+		}
+		return target != original.link, nil
+	}
+	if info.Size() != original.size {
+		return true, nil
+	}
+	if info.ModTime().Equal(original.mtime) && original.mtime.Before(w.start.Add(-workspaceMtimeWindow)) {
+		return false, nil
+	}
+	oldHash, err := hashFile(path.Join(w.src, relPath))
+	if err != nil {
+		return false, err
+	}
+	newHash, err := hashFile(path.Join(w.dir, relPath))
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(oldHash, newHash), nil
+}
+
+func hashFile(filePath string) ([]byte, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
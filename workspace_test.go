@@ -0,0 +1,142 @@
+package main
+
+import (
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWorkspace_Changes(t *testing.T) {
+	src := t.TempDir()
+	writeTestFile(t, src, ".gitignore", "*.log\n")
+	writeTestFile(t, src, ".git/HEAD", "ref: refs/heads/main\n")
+	writeTestFile(t, src, "modified.txt", "old")
+	writeTestFile(t, src, "touched.txt", "old")
+	writeTestFile(t, src, "chmod.sh", "old")
+	writeTestFile(t, src, "dir/deleted.txt", "old")
+	writeTestFile(t, src, "same.txt", "old")
+	writeTestFile(t, src, "old.log", "old")
+	if err := os.Symlink("same.txt", path.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	workspace, err := NewWorkspace(src, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dir, ".git")); !os.IsNotExist(err) {
+		t.Errorf(".git copied: %v", err)
+	}
+	if target, err := os.Readlink(path.Join(dir, "link")); err != nil || target != "same.txt" {
+		t.Errorf("link=%s err=%v", target, err)
+	}
+
+	// same size, so only the content comparison finds it
+	writeTestFile(t, dir, "modified.txt", "new")
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path.Join(dir, "touched.txt"), future, future); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path.Join(dir, "chmod.sh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path.Join(dir, "dir/deleted.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path.Join(dir, "old.log")); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, dir, "dir/added.txt", "new")
+	writeTestFile(t, dir, "new.log", "new")
+
+	result, err := workspace.Changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := result.getPathsChanged(), []string{"chmod.sh", "dir/added.txt", "dir/deleted.txt", "modified.txt"}; !slices.Equal(got, want) {
+		t.Fatalf("changed=%v want=%v", got, want)
+	}
+	if !result.isAdded("dir/added.txt") || !result.isDeleted("dir/deleted.txt") || result.isAdded("modified.txt") {
+		t.Errorf("added=%v deleted=%v", sortedKeys(result.pathsAdded), sortedKeys(result.pathsDeleted))
+	}
+}
+
+func TestWorkspace_RacyMtime(t *testing.T) {
+	src := t.TempDir()
+	writeTestFile(t, src, "racy.txt", "old")
+	writeTestFile(t, src, "settled.txt", "old")
+	settled := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path.Join(src, "settled.txt"), settled, settled); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	workspace, err := NewWorkspace(src, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a coarse filesystem clock gives the rewritten file the mtime it was copied with
+	for _, relPath := range []string{"racy.txt", "settled.txt"} {
+		info, err := os.Stat(path.Join(dir, relPath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, dir, relPath, "new")
+		if err := os.Chtimes(path.Join(dir, relPath), info.ModTime(), info.ModTime()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := workspace.Changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// settled.txt is trusted by its metadata, which is the point of the copy mode
+	if got := result.getPathsChanged(); !slices.Equal(got, []string{"racy.txt"}) {
+		t.Errorf("changed=%v", got)
+	}
+}
+
+func TestRunUpdateScript_CopyWorkspace(t *testing.T) {
+	root := path.Join(t.TempDir(), "repo")
+	writeTestFile(t, root, "version.txt", "1.2")
+	script := UpdateScript{
+		Executable: "sh",
+		Args:       []string{"-c", "echo 1.3 > version.txt && pwd > workspace.txt"},
+		Workspace:  string(WorkspaceCopy),
+	}
+	result, err := RunUpdateScript(ScriptBuild{Output: "/bin"}, &script, root, &ScriptEnv{}, NewSnapshot(root), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := result.getPathsChanged(); !slices.Equal(got, []string{"version.txt", "workspace.txt"}) {
+		t.Errorf("changed=%v", got)
+	}
+	buf, err := os.ReadFile(path.Join(root, "workspace.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// next to the flake root, so that reflinks work
+	if workDir := strings.TrimSpace(string(buf)); path.Dir(workDir) != path.Dir(root) {
+		t.Errorf("workspace=%s root=%s", workDir, root)
+	}
+	if _, err := os.Stat(strings.TrimSpace(string(buf))); !os.IsNotExist(err) {
+		t.Errorf("workspace not removed: %v", err)
+	}
+}
+
+func TestNewWorkspaceDir(t *testing.T) {
+	root := t.TempDir()
+	for mode, wantParent := range map[WorkspaceMode]string{WorkspaceCopy: path.Dir(root), WorkspaceGit: os.TempDir(), "": os.TempDir()} {
+		dir, err := newWorkspaceDir(mode, root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = os.Remove(dir)
+		if path.Dir(dir) != wantParent {
+			t.Errorf("mode=%q dir=%s want parent=%s", mode, dir, wantParent)
+		}
+	}
+}